@@ -0,0 +1,284 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"./filters"
+	"./filters/autoproxy"
+	"./filters/gae"
+	"./filters/stripssl"
+	"./helpers"
+	"./metrics"
+)
+
+const (
+	// AdminProfile is the reserved profile name in httpproxy.json which
+	// configures the admin listener instead of a proxy.
+	AdminProfile string = "Admin"
+)
+
+var (
+	adminServer *http.Server
+)
+
+// ServeAdmin serves the JSON status and control API of the running profiles
+// and filters on config.Address. Only Address, ReadTimeout and WriteTimeout
+// of config are used.
+func ServeAdmin(config Config) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/profiles", adminGet(adminProfiles))
+	mux.HandleFunc("/filters", adminGet(adminFilters))
+	mux.HandleFunc("/config", adminConfig)
+	mux.HandleFunc("/reload", adminPost(adminReload))
+	mux.HandleFunc("/gae/blacklist/clear", adminPost(adminGAE(adminClearBlackList)))
+	mux.HandleFunc("/gae/appid/toggle", adminPost(adminGAE(adminToggleAppID)))
+	mux.HandleFunc("/gae/dns/flush", adminPost(adminGAE(adminFlushDNS)))
+	mux.HandleFunc("/gae/cache/clear", adminPost(adminGAE(adminClearCache)))
+
+	server := &http.Server{
+		Addr:         config.Address,
+		Handler:      mux,
+		ReadTimeout:  time.Duration(config.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(config.WriteTimeout) * time.Second,
+	}
+
+	profilesMu.Lock()
+	adminServer = server
+	profilesMu.Unlock()
+
+	glog.Infof("httpproxy: admin listening on %s", config.Address)
+
+	return server.ListenAndServe()
+}
+
+func adminGet(h func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(rw, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		adminServe(rw, req, h)
+	}
+}
+
+func adminPost(h func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(rw, "405 method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		glog.Infof("httpproxy: admin %s %s from %s", req.Method, req.URL.String(), req.RemoteAddr)
+		adminServe(rw, req, h)
+	}
+}
+
+func adminServe(rw http.ResponseWriter, req *http.Request, h func(*http.Request) (interface{}, error)) {
+	v, err := h(req)
+	if err != nil {
+		glog.Warningf("httpproxy: admin %s %s error: %+v", req.Method, req.URL.String(), err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	e := json.NewEncoder(rw)
+	e.SetIndent("", "\t")
+	e.Encode(v)
+}
+
+type adminProfile struct {
+	Address          string
+	RequestFilters   []string
+	RoundTripFilters []string
+	ResponseFilters  []string
+}
+
+func adminProfiles(req *http.Request) (interface{}, error) {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+
+	m := make(map[string]adminProfile, len(profiles))
+	for name, p := range profiles {
+		h := p.handler.Load().(Handler)
+		ap := adminProfile{
+			Address:          h.Listener.Addr().String(),
+			RequestFilters:   []string{},
+			RoundTripFilters: []string{},
+			ResponseFilters:  []string{},
+		}
+		for _, f := range h.RequestFilters {
+			ap.RequestFilters = append(ap.RequestFilters, f.FilterName())
+		}
+		for _, f := range h.RoundTripFilters {
+			ap.RoundTripFilters = append(ap.RoundTripFilters, f.FilterName())
+		}
+		for _, f := range h.ResponseFilters {
+			ap.ResponseFilters = append(ap.ResponseFilters, f.FilterName())
+		}
+		m[name] = ap
+	}
+
+	return m, nil
+}
+
+type adminCache struct {
+	Len int
+}
+
+type adminGAEStatus struct {
+	Servers struct {
+		Good  []string
+		Bad   []string
+		Stats map[string]gae.ServerStats
+	}
+	MultiDialer helpers.MultiDialerStatus
+}
+
+type adminAutoProxyStatus struct {
+	RegionFilterCache *adminCache
+}
+
+type adminStripSSLStatus struct {
+	TLSConfigCache adminCache
+}
+
+func adminFilters(req *http.Request) (interface{}, error) {
+	m := make(map[string]interface{})
+	for name, f := range filters.Filters() {
+		switch f := f.(type) {
+		case *gae.Filter:
+			var status adminGAEStatus
+			urls1, urls2 := f.GAETransport.Servers.URLs()
+			status.Servers.Good = adminHosts(urls1)
+			status.Servers.Bad = adminHosts(urls2)
+			status.Servers.Stats = f.GAETransport.Servers.Stats()
+			status.MultiDialer = f.Transport.MultiDialer.Status()
+			m[name] = status
+		case *autoproxy.Filter:
+			var status adminAutoProxyStatus
+			if f.RegionFilterCache != nil {
+				status.RegionFilterCache = &adminCache{Len: f.RegionFilterCache.Len()}
+			}
+			m[name] = status
+		case *stripssl.Filter:
+			m[name] = adminStripSSLStatus{
+				TLSConfigCache: adminCache{Len: f.TLSConfigCache.Len()},
+			}
+		}
+	}
+	return m, nil
+}
+
+func adminHosts(urls []url.URL) []string {
+	hosts := make([]string, 0, len(urls))
+	for _, u := range urls {
+		hosts = append(hosts, u.Host)
+	}
+	return hosts
+}
+
+// adminConfig dumps the effective config of the "filter" form value, or of
+// httpproxy.json and all its filters, in the "format" form value which is
+// "json" by default or "jsonc".
+func adminConfig(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(rw, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dumps, err := DumpConfig(req.FormValue("filter"))
+	if err != nil {
+		glog.Warningf("httpproxy: admin %s %s error: %+v", req.Method, req.URL.String(), err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := req.FormValue("format")
+	switch format {
+	case "", "json":
+		format = "json"
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	case "jsonc":
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		http.Error(rw, fmt.Sprintf("unsupported format %#v", format), http.StatusBadRequest)
+		return
+	}
+
+	WriteConfigDump(rw, dumps, format)
+}
+
+func adminReload(req *http.Request) (interface{}, error) {
+	if err := Reload(); err != nil {
+		return nil, err
+	}
+	return adminProfiles(req)
+}
+
+// adminGAE applies h to the gae filter named by the "filter" form value, or
+// to all gae filter instances if it is empty, and returns the names of the
+// filters it was applied to.
+func adminGAE(h func(*http.Request, *gae.Filter) error) func(*http.Request) (interface{}, error) {
+	return func(req *http.Request) (interface{}, error) {
+		name := req.FormValue("filter")
+
+		names := []string{}
+		for name1, f := range filters.Filters() {
+			f1, ok := f.(*gae.Filter)
+			if !ok || (name != "" && name != name1) {
+				continue
+			}
+			if err := h(req, f1); err != nil {
+				return nil, fmt.Errorf("%s: %+v", name1, err)
+			}
+			names = append(names, name1)
+		}
+
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no gae filter matches %#v", name)
+		}
+
+		return names, nil
+	}
+}
+
+func adminClearBlackList(req *http.Request, f *gae.Filter) error {
+	md := f.Transport.MultiDialer
+	md.IPBlackList.Clear()
+	for _, ip := range f.Config.IPBlackList {
+		md.IPBlackList.Set(ip, struct{}{}, time.Time{})
+	}
+	return nil
+}
+
+func adminToggleAppID(req *http.Request, f *gae.Filter) error {
+	appid := req.FormValue("appid")
+	if appid == "" {
+		return fmt.Errorf("appid is required")
+	}
+
+	host := appid
+	if !strings.Contains(host, ".") {
+		host += ".appspot.com"
+	}
+
+	return f.GAETransport.Servers.ToggleServer(host)
+}
+
+func adminFlushDNS(req *http.Request, f *gae.Filter) error {
+	f.Transport.MultiDialer.Resolver.LRUCache.Clear()
+	return nil
+}
+
+func adminClearCache(req *http.Request, f *gae.Filter) error {
+	f.Transport.MultiDialer.ClearCache()
+	return nil
+}
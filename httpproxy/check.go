@@ -0,0 +1,124 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"./filters"
+	"./storage"
+)
+
+// Check validates httpproxy.json and the configs of all filters which its
+// enabled profiles refer to, without building the filters or listening. It
+// returns every problem found, most of them as *storage.ConfigError.
+func Check() []error {
+	store := storage.LookupStoreByFilterName("httpproxy")
+
+	config := make(map[string]Config)
+	errs, ok := storage.CheckJson(store, ConfigFilename, &config)
+	if !ok {
+		return errs
+	}
+
+	if stores, err := newRemoteStores(config); err != nil {
+		errs = append(errs, &storage.ConfigError{Filename: storage.Path(store, ConfigFilename), Err: err})
+	} else {
+		setRemoteStores(stores)
+	}
+
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	checked := make(map[string]struct{})
+	var checkFilter func(name string)
+	checkFilter = func(name string) {
+		if _, ok := checked[name]; ok {
+			return
+		}
+		checked[name] = struct{}{}
+
+		c, errs1 := filters.CheckConfig(name)
+		errs = append(errs, errs1...)
+
+		if r, ok := c.(filters.ConfigReferrer); ok {
+			for _, name1 := range r.ReferredFilters() {
+				checkFilter(name1)
+			}
+		}
+	}
+
+	for _, name := range names {
+		c := config[name]
+		if !c.Enabled {
+			continue
+		}
+
+		for _, err := range checkProfile(c) {
+			errs = append(errs, &storage.ConfigError{Filename: storage.Path(store, ConfigFilename), Err: fmt.Errorf("profile %#v %v", name, err)})
+		}
+
+		for _, names := range [][]string{c.RequestFilters, c.RoundTripFilters, c.ResponseFilters} {
+			for _, name := range names {
+				checkFilter(name)
+			}
+		}
+
+		if c.TLS.Enabled && c.TLS.IssueByRootCA {
+			checkFilter("stripssl")
+		}
+	}
+
+	return errs
+}
+
+// checkProfile reports the invalid and conflicting options of a profile,
+// which ServeProfile and NewHandler would refuse.
+func checkProfile(config Config) []error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		errs = append(errs, fmt.Errorf("Address %#v error: %v", config.Address, err))
+	}
+
+	switch config.Transparent {
+	case "", TransparentRedirect, TransparentTProxy:
+	default:
+		errs = append(errs, fmt.Errorf("Transparent should be %#v or %#v, got %#v", TransparentRedirect, TransparentTProxy, config.Transparent))
+	}
+
+	if config.Transparent != "" && config.EnableSocks {
+		errs = append(errs, fmt.Errorf("EnableSocks is conflict with Transparent %#v", config.Transparent))
+	}
+
+	if config.Transparent != "" && config.TLS.Enabled {
+		errs = append(errs, fmt.Errorf("TLS is conflict with Transparent %#v", config.Transparent))
+	}
+
+	if c := config.TLS; c.Enabled && (c.CertFile == "" || c.KeyFile == "") && !c.IssueByRootCA {
+		errs = append(errs, fmt.Errorf("TLS needs CertFile and KeyFile, or IssueByRootCA"))
+	}
+
+	if config.ProxyProtocol.Enabled && len(config.ProxyProtocol.TrustedProxies) == 0 {
+		errs = append(errs, fmt.Errorf("ProxyProtocol needs TrustedProxies"))
+	}
+
+	if _, err := parseCIDRs(config.ProxyProtocol.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("ProxyProtocol %v", err))
+	}
+
+	if len(config.Fallthrough.Errors) > 0 {
+		if _, err := NewFallthroughPolicy(config.Fallthrough.Errors, config.Fallthrough.MaxBodySize); err != nil {
+			errs = append(errs, fmt.Errorf("Fallthrough %v", err))
+		}
+	}
+
+	if _, err := NewTracePolicy(config.Trace.Header, config.Trace.AllowedIPs, config.Trace.Verbosity); err != nil {
+		errs = append(errs, fmt.Errorf("Trace %v", err))
+	}
+
+	return errs
+}
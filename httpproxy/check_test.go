@@ -0,0 +1,46 @@
+package httpproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"./storage"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpproxy-check")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, ConfigFilename), []byte(`{
+	"Default": {
+		"Enabled": true,
+		"Address": "127.0.0.1:8087",
+		"EnableSocks": true,
+		"Transparent": "redirect",
+	},
+}
+`), 0644)
+
+	defer os.Setenv(storage.StoreEnv, os.Getenv(storage.StoreEnv))
+	os.Setenv(storage.StoreEnv, dir)
+
+	errs := Check()
+	want := filepath.Join(dir, ConfigFilename) + `: profile "Default" EnableSocks is conflict with Transparent "redirect"`
+	if len(errs) != 1 || errs[0].Error() != want {
+		t.Errorf("Check should report %#v, got %v", want, errs)
+	}
+
+	profile := Config{Address: "127.0.0.1:8088", Transparent: "redirect"}
+	profile.TLS.Enabled = true
+	profile.TLS.IssueByRootCA = true
+	errs = checkProfile(profile)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "TLS is conflict with Transparent") {
+		t.Errorf("checkProfile should report the conflict of TLS and Transparent, got %v", errs)
+	}
+}
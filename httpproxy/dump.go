@@ -0,0 +1,134 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"./filters"
+	"./storage"
+)
+
+// DumpConfig returns the effective configs of filter instance name, or of
+// httpproxy.json as "httpproxy" and all the filters which its enabled profiles
+// refer to if name is empty.
+func DumpConfig(name string) (map[string]*storage.Dump, error) {
+	dumps := make(map[string]*storage.Dump)
+
+	var dumpFilter func(name string) error
+	dumpFilter = func(name string) error {
+		if _, ok := dumps[name]; ok {
+			return nil
+		}
+
+		c, dump, err := filters.DumpConfig(name)
+		if err != nil {
+			return err
+		}
+		dumps[name] = dump
+
+		if r, ok := c.(filters.ConfigReferrer); ok {
+			for _, name1 := range r.ReferredFilters() {
+				if err := dumpFilter(name1); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	store := storage.LookupStoreByFilterName("httpproxy")
+
+	// the Stores of httpproxy.json decide where the filters are read from
+	config := make(map[string]Config)
+	sources, err := storage.MergeJson(store, &config, ConfigFilename)
+	if err != nil {
+		return nil, fmt.Errorf("storage.MergeJson(%#v) failed: %s", ConfigFilename, err)
+	}
+
+	stores, err := newRemoteStores(config)
+	if err != nil {
+		return nil, err
+	}
+	setRemoteStores(stores)
+
+	if name != "" && name != "httpproxy" {
+		if err := dumpFilter(name); err != nil {
+			return nil, err
+		}
+		return dumps, nil
+	}
+
+	if dumps["httpproxy"], err = storage.NewDump(config, sources, nil); err != nil {
+		return nil, err
+	}
+
+	if name != "" {
+		return dumps, nil
+	}
+
+	for _, c := range config {
+		if !c.Enabled {
+			continue
+		}
+
+		for _, names := range [][]string{c.RequestFilters, c.RoundTripFilters, c.ResponseFilters} {
+			for _, name := range names {
+				if err := dumpFilter(name); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if c.TLS.Enabled && c.TLS.IssueByRootCA {
+			if err := dumpFilter("stripssl"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return dumps, nil
+}
+
+// WriteConfigDump writes dumps keyed by their names in format "json", as the
+// configs with their sources, or "jsonc", as the configs annotated by comment
+// lines of their sources.
+func WriteConfigDump(w io.Writer, dumps map[string]*storage.Dump, format string) error {
+	switch format {
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "\t")
+		return e.Encode(dumps)
+	case "jsonc":
+		names := make([]string, 0, len(dumps))
+		for name := range dumps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		if _, err := io.WriteString(w, "{\n"); err != nil {
+			return err
+		}
+		for i, name := range names {
+			if _, err := fmt.Fprintf(w, "\t%q: ", name); err != nil {
+				return err
+			}
+			if err := dumps[name].WriteJsonc(w, "\t"); err != nil {
+				return err
+			}
+			sep := ",\n"
+			if i == len(names)-1 {
+				sep = "\n"
+			}
+			if _, err := io.WriteString(w, sep); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, "}\n")
+		return err
+	default:
+		return fmt.Errorf("unsupported config dump format %#v", format)
+	}
+}
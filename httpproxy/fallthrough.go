@@ -0,0 +1,98 @@
+package httpproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"./filters"
+	"./helpers"
+)
+
+// FallthroughPolicy lets the RoundTrip errors of the configured classes fall
+// through to the next RoundTripFilter of a profile, for the requests which
+// can be sent again.
+type FallthroughPolicy struct {
+	Errors      map[string]struct{}
+	MaxBodySize int64
+}
+
+func NewFallthroughPolicy(errors []string, maxBodySize int64) (*FallthroughPolicy, error) {
+	p := &FallthroughPolicy{
+		Errors:      make(map[string]struct{}),
+		MaxBodySize: maxBodySize,
+	}
+
+	for _, class := range errors {
+		switch class {
+		case filters.ErrorClassDial, filters.ErrorClassQuota, filters.ErrorClassTimeout:
+			p.Errors[class] = struct{}{}
+		default:
+			return nil, fmt.Errorf("unknown error class %#v", class)
+		}
+	}
+
+	return p, nil
+}
+
+// Match reports whether err of req should fall through to the next
+// RoundTripFilter. A CONNECT request falls through only on the dial errors,
+// which come before its tunnel is established.
+func (p *FallthroughPolicy) Match(req *http.Request, err error) bool {
+	class := filters.ErrorClass(err)
+	if req.Method == http.MethodConnect && class != filters.ErrorClassDial {
+		return false
+	}
+	_, ok := p.Errors[class]
+	return ok
+}
+
+// Replayable prepares req to be sent by more than one RoundTripFilter, and
+// returns the func to rewind it before each retry, or nil if req cannot be
+// sent again. Idempotent and CONNECT requests without a body are always
+// replayable, the others only if their body fits in MaxBodySize and is
+// buffered here.
+func (p *FallthroughPolicy) Replayable(req *http.Request) (func(), error) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		if !isIdempotent(req.Method) && req.Method != http.MethodConnect {
+			return nil, nil
+		}
+		return func() {}, nil
+	}
+
+	if p.MaxBodySize <= 0 || req.ContentLength > p.MaxBodySize {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, p.MaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > p.MaxBodySize {
+		// a chunked body larger than MaxBodySize, stream it as usual
+		req.Body = helpers.ReaderCloser{Reader: io.MultiReader(bytes.NewReader(body), req.Body), Closer: req.Body}
+		return nil, nil
+	}
+
+	rewind := func() {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	rewind()
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	return rewind, nil
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"./filters"
+	"./helpers"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) FilterName() string {
+	return "test"
+}
+
+func (f roundTripFunc) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	resp, err := f(req)
+	return ctx, resp, err
+}
+
+func testFallthrough(t *testing.T, err error, req *http.Request) *httptest.ResponseRecorder {
+	p, err1 := NewFallthroughPolicy([]string{filters.ErrorClassDial}, 1024)
+	if err1 != nil {
+		t.Fatalf("NewFallthroughPolicy error: %+v", err1)
+	}
+
+	ln, err1 := helpers.ListenTCP("tcp", "127.0.0.1:0", nil)
+	if err1 != nil {
+		t.Fatalf("ListenTCP error: %+v", err1)
+	}
+	defer ln.Close()
+
+	h := Handler{
+		Listener:    ln,
+		Fallthrough: p,
+		RoundTripFilters: []filters.RoundTripFilter{
+			roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				ioutil.ReadAll(req.Body)
+				return nil, err
+			}),
+			roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(req.Body)
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{},
+					Body:          ioutil.NopCloser(strings.NewReader(string(body))),
+					ContentLength: int64(len(body)),
+				}, nil
+			}),
+		},
+	}
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func TestFallthroughDialError(t *testing.T) {
+	err := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	req := httptest.NewRequest(http.MethodPost, "http://example.org/", strings.NewReader("hello"))
+
+	rw := testFallthrough(t, err, req)
+	if rw.Code != http.StatusOK || rw.Body.String() != "hello" {
+		t.Errorf("POST should fall through with its body, got %d %#v", rw.Code, rw.Body.String())
+	}
+}
+
+func TestFallthroughOtherError(t *testing.T) {
+	err := errors.New("unexpected EOF")
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+
+	rw := testFallthrough(t, err, req)
+	if rw.Code != http.StatusBadGateway {
+		t.Errorf("other errors should not fall through, got %d", rw.Code)
+	}
+}
+
+func TestFallthroughConnect(t *testing.T) {
+	err := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	req := httptest.NewRequest(http.MethodConnect, "example.org:443", nil)
+
+	rw := testFallthrough(t, err, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("CONNECT should fall through on the dial errors, got %d", rw.Code)
+	}
+
+	p, err1 := NewFallthroughPolicy([]string{filters.ErrorClassDial, filters.ErrorClassTimeout}, 0)
+	if err1 != nil {
+		t.Fatalf("NewFallthroughPolicy error: %+v", err1)
+	}
+
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: &timeoutError{}}
+	if p.Match(req, timeout) {
+		t.Errorf("CONNECT should not fall through on %v", timeout)
+	}
+	if !p.Match(httptest.NewRequest(http.MethodGet, "http://example.org/", nil), timeout) {
+		t.Errorf("GET should fall through on %v", timeout)
+	}
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
@@ -0,0 +1,251 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"../../filters"
+	"../../helpers"
+)
+
+const (
+	filterName string = "accesslog"
+)
+
+type Config struct {
+	Filename string
+	Format   string
+	Rotate   struct {
+		MaxSize    int
+		Interval   int
+		MaxBackups int
+	}
+}
+
+type Filter struct {
+	name string
+	Config
+	JSON   bool
+	Writer *RotateWriter
+}
+
+func init() {
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		config := new(Config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
+		if err != nil {
+			return nil, err
+		}
+		f.(*Filter).name = name
+		return f, nil
+	})
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	var isJSON bool
+	switch config.Format {
+	case "", "combined":
+	case "json":
+		isJSON = true
+	default:
+		return nil, fmt.Errorf("ACCESSLOG: unknown Format %#v", config.Format)
+	}
+
+	w, err := NewRotateWriter(config.Filename,
+		int64(config.Rotate.MaxSize)*1024*1024,
+		time.Duration(config.Rotate.Interval)*time.Second,
+		config.Rotate.MaxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("ACCESSLOG: NewRotateWriter(%#v) error: %+v", config.Filename, err)
+	}
+
+	f := &Filter{
+		name:   filterName,
+		Config: *config,
+		JSON:   isJSON,
+		Writer: w,
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return f.name
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil {
+		return ctx, resp, nil
+	}
+
+	r := f.newRecord(ctx, req)
+	r.Status = resp.StatusCode
+	if addr, err := helpers.ReflectRemoteAddrFromResponse(resp); err == nil {
+		r.Upstream = addr
+	}
+
+	if resp.Body == nil {
+		f.write(r)
+		return ctx, resp, nil
+	}
+
+	body := &recordBody{
+		ReadCloser: resp.Body,
+		done: func(n int64) {
+			r.BytesOut = n
+			f.write(r)
+		},
+	}
+
+	if _, ok := resp.Body.(onErrorer); ok {
+		resp.Body = &recordOnErrorBody{body}
+	} else {
+		resp.Body = body
+	}
+
+	return ctx, resp, nil
+}
+
+func (f *Filter) Hijacked(ctx context.Context, req *http.Request, bytesIn, bytesOut int64) {
+	r := f.newRecord(ctx, req)
+	r.Status = http.StatusOK
+	r.BytesIn = bytesIn
+	r.BytesOut = bytesOut
+	f.write(r)
+}
+
+type record struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Proto     string    `json:"proto"`
+	Filter    string    `json:"filter"`
+	Status    int       `json:"status"`
+	BytesIn   int64     `json:"bytes_in"`
+	BytesOut  int64     `json:"bytes_out"`
+	Duration  float64   `json:"duration"`
+	Upstream  string    `json:"upstream"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"user_agent"`
+}
+
+func (f *Filter) newRecord(ctx context.Context, req *http.Request) *record {
+	r := &record{
+		Time:      filters.GetStartTime(ctx),
+		Client:    req.RemoteAddr,
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Proto:     req.Proto,
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	}
+
+	if req.Method == http.MethodConnect {
+		r.URL = req.Host
+	}
+
+	if req.ContentLength > 0 {
+		r.BytesIn = req.ContentLength
+	}
+
+	if f1 := filters.GetRoundTripFilter(ctx); f1 != nil {
+		r.Filter = f1.FilterName()
+	}
+
+	return r
+}
+
+func (f *Filter) write(r *record) {
+	r.Duration = time.Since(r.Time).Seconds()
+
+	var line []byte
+	if f.JSON {
+		line, _ = json.Marshal(r)
+		line = append(line, '\n')
+	} else {
+		line = []byte(formatCombined(r))
+	}
+
+	f.Writer.Write(line)
+}
+
+// formatCombined formats r in the Combined Log Format, followed by the
+// RoundTrip filter, bytes in, duration in seconds and upstream address.
+func formatCombined(r *record) string {
+	host, _, err := net.SplitHostPort(r.Client)
+	if err != nil {
+		host = r.Client
+	}
+
+	return fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %d \"%s\" \"%s\" %s %d %.3f %s\n",
+		dash(host),
+		r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, escape(r.URL), r.Proto,
+		r.Status,
+		r.BytesOut,
+		escape(dash(r.Referer)),
+		escape(dash(r.UserAgent)),
+		dash(r.Filter),
+		r.BytesIn,
+		r.Duration,
+		dash(r.Upstream))
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// recordBody calls done with the bytes read once the body is closed.
+type recordBody struct {
+	io.ReadCloser
+	n    int64
+	once int32
+	done func(n int64)
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *recordBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.once, 0, 1) {
+		b.done(b.n)
+	}
+	return b.ReadCloser.Close()
+}
+
+type onErrorer interface {
+	OnError(err error)
+}
+
+// recordOnErrorBody keeps the OnError hook of the wrapped body, which
+// Handler.ServeHTTP calls when copying the body fails.
+type recordOnErrorBody struct {
+	*recordBody
+}
+
+func (b *recordOnErrorBody) OnError(err error) {
+	b.ReadCloser.(onErrorer).OnError(err)
+}
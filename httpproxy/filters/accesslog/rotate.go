@@ -0,0 +1,138 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	backupTimeFormat string = "20060102-150405"
+)
+
+// RotateWriter appends to filename, and renames it to a timestamped backup
+// once it grows over maxSize bytes or is older than interval. Only the
+// newest maxBackups backups are kept. Zero values disable each limit.
+type RotateWriter struct {
+	filename   string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+func NewRotateWriter(filename string, maxSize int64, interval time.Duration, maxBackups int) (*RotateWriter, error) {
+	w := &RotateWriter{
+		filename:   filename,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *RotateWriter) open() error {
+	if dir := filepath.Dir(w.filename); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = fi.Size()
+	w.created = time.Now()
+	if fi.Size() > 0 {
+		w.created = fi.ModTime()
+	}
+
+	return nil
+}
+
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size > 0 && w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotateWriter) shouldRotate(n int64) bool {
+	if w.maxSize > 0 && w.size+n > w.maxSize {
+		return true
+	}
+	if w.interval > 0 && time.Since(w.created) >= w.interval {
+		return true
+	}
+	return false
+}
+
+func (w *RotateWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(w.filename)
+	backup := strings.TrimSuffix(w.filename, ext) + "-" + time.Now().Format(backupTimeFormat) + ext
+	if err := os.Rename(w.filename, backup); err != nil {
+		return err
+	}
+
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	if w.maxBackups > 0 {
+		w.removeBackups()
+	}
+
+	return nil
+}
+
+func (w *RotateWriter) removeBackups() {
+	ext := filepath.Ext(w.filename)
+	backups, err := filepath.Glob(strings.TrimSuffix(w.filename, ext) + "-*" + ext)
+	if err != nil || len(backups) <= w.maxBackups {
+		return
+	}
+
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-w.maxBackups] {
+		os.Remove(backup)
+	}
+}
+
+func (w *RotateWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
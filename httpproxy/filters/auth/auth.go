@@ -13,7 +13,6 @@ import (
 	"github.com/phuslu/glog"
 
 	"../../filters"
-	"../../storage"
 )
 
 const (
@@ -30,6 +29,7 @@ type Config struct {
 }
 
 type Filter struct {
+	name string
 	Config
 	AuthCache lrucache.Cache
 	Basic     map[string]string
@@ -37,19 +37,24 @@ type Filter struct {
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
 		config := new(Config)
-		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
 		if err != nil {
-			glog.Fatalf("UnmarshallJson(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		f.(*Filter).name = name
+		return f, nil
 	})
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
 	f := &Filter{
+		name:      filterName,
 		Config:    *config,
 		AuthCache: lrucache.NewMultiLRUCache(uint(runtime.NumCPU()), uint(config.CacheSize)),
 		Basic:     make(map[string]string),
@@ -68,7 +73,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
 }
 
 func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
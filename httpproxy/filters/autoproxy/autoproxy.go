@@ -2,11 +2,13 @@ package autoproxy
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -64,6 +66,31 @@ type Config struct {
 	}
 }
 
+// ReferredFilters returns the filters of the enabled site and region rules.
+func (c *Config) ReferredFilters() []string {
+	var rules []map[string]string
+	if c.SiteFilters.Enabled {
+		rules = append(rules, c.SiteFilters.Rules)
+	}
+	if c.RegionFilters.Enabled {
+		rules = append(rules, c.RegionFilters.Rules, c.RegionFilters.IPRules)
+	}
+
+	names := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, m := range rules {
+		for _, name := range m {
+			if _, ok := seen[name]; !ok && name != "" {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
 var (
 	onceUpdater sync.Once
 )
@@ -77,6 +104,7 @@ type GFWList struct {
 }
 
 type Filter struct {
+	name string
 	Config
 	Store                storage.Store
 	IndexFilesEnabled    bool
@@ -106,15 +134,18 @@ func init() {
 	mime.AddExtensionType(".crt", "application/x-x509-ca-cert")
 	mime.AddExtensionType(".mobileconfig", "application/x-apple-aspen-config")
 
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
 		config := new(Config)
-		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-
-		return NewFilter(config)
+		f.(*Filter).name = name
+		return f, nil
 	})
 }
 
@@ -142,6 +173,7 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 	transport := &http.Transport{}
 
 	f := &Filter{
+		name:                 filterName,
 		Config:               *config,
 		Store:                store,
 		IndexFilesEnabled:    config.IndexFiles.Enabled,
@@ -173,10 +205,10 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		for host, name := range config.SiteFilters.Rules {
 			f, err := filters.GetFilter(name)
 			if err != nil {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) for %#v error: %v", name, host, err)
+				return nil, fmt.Errorf("AUTOPROXY: filters.GetFilter(%#v) for %#v error: %v", name, host, err)
 			}
 			if _, ok := f.(filters.RoundTripFilter); !ok {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
+				return nil, fmt.Errorf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
 			}
 			fm[host] = f
 		}
@@ -186,13 +218,13 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 	if f.RegionFiltersEnabled {
 		resp, err := store.Get(f.Config.RegionFilters.DataFile)
 		if err != nil {
-			glog.Fatalf("AUTOPROXY: store.Get(%#v) error: %v", f.Config.RegionFilters.DataFile, err)
+			return nil, fmt.Errorf("AUTOPROXY: store.Get(%#v) error: %v", f.Config.RegionFilters.DataFile, err)
 		}
 		defer resp.Body.Close()
 
 		data, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			glog.Fatalf("AUTOPROXY: ioutil.ReadAll(%#v) error: %v", resp.Body, err)
+			return nil, fmt.Errorf("AUTOPROXY: ioutil.ReadAll(%#v) error: %v", resp.Body, err)
 		}
 
 		f.RegionLocator = ip17mon.NewLocatorWithData(data)
@@ -201,7 +233,7 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		if config.RegionFilters.EnableRemoteDNS {
 			f.RegionResolver.DNSServer = net.ParseIP(config.RegionFilters.DNSServer)
 			if f.RegionResolver.DNSServer == nil {
-				glog.Fatalf("AUTOPROXY: net.ParseIP(%+v) failed", config.RegionFilters.DNSServer)
+				return nil, fmt.Errorf("AUTOPROXY: net.ParseIP(%+v) failed", config.RegionFilters.DNSServer)
 			}
 		}
 
@@ -212,11 +244,11 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 			}
 			f, err := filters.GetFilter(name)
 			if err != nil {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) for %#v error: %v", name, region, err)
+				return nil, fmt.Errorf("AUTOPROXY: filters.GetFilter(%#v) for %#v error: %v", name, region, err)
 			}
 			f1, ok := f.(filters.RoundTripFilter)
 			if !ok {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
+				return nil, fmt.Errorf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
 			}
 			fm[strings.ToLower(region)] = f1
 		}
@@ -230,11 +262,11 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 			}
 			f, err := filters.GetFilter(name)
 			if err != nil {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) for %#v error: %v", name, ip, err)
+				return nil, fmt.Errorf("AUTOPROXY: filters.GetFilter(%#v) for %#v error: %v", name, ip, err)
 			}
 			f1, ok := f.(filters.RoundTripFilter)
 			if !ok {
-				glog.Fatalf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
+				return nil, fmt.Errorf("AUTOPROXY: filters.GetFilter(%#v) return %T, not a RoundTripFilter", name, f)
 			}
 			fm[ip] = f1
 		}
@@ -251,7 +283,7 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
 }
 
 func (f *Filter) FindCountryByIP(ip string) (string, error) {
@@ -282,6 +314,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 	if f.BlackListEnabled {
 		if f.BlackListSiteMatcher.Match(host) {
 			glog.V(2).Infof("%s \"AUTOPROXY BlackList %s %s %s\"", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+			filters.Tracef(ctx, f.name, "BlackList", "%s blocked", host)
 			return ctx, filters.DummyRequest, nil
 		}
 	}
@@ -289,6 +322,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 	if f.SiteFiltersEnabled {
 		if f1, ok := f.SiteFiltersRules.Lookup(host); ok {
 			glog.V(2).Infof("%s \"AUTOPROXY SiteFilters %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
+			filters.Tracef(ctx, f.name, "SiteFilters", "%s with %s", host, f1.(filters.Filter).FilterName())
 			filters.SetRoundTripFilter(ctx, f1.(filters.RoundTripFilter))
 			return ctx, req, nil
 		}
@@ -297,31 +331,39 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 	if f.RegionFiltersEnabled {
 		if f1, ok := f.RegionFilterCache.Get(host); ok {
 			if f1 != nil {
+				filters.Tracef(ctx, f.name, "RegionFilterCache", "%s with %s", host, f1.(filters.Filter).FilterName())
 				filters.SetRoundTripFilter(ctx, f1.(filters.RoundTripFilter))
+			} else {
+				filters.Tracef(ctx, f.name, "RegionFilterCache", "%s with none", host)
 			}
 		} else if ips, err := f.RegionResolver.LookupIP(host); err == nil && len(ips) > 0 {
 			ip := ips[0]
 
 			if ip.IsLoopback() && !(strings.Contains(host, ".local") || strings.Contains(host, "localhost.")) {
 				glog.V(2).Infof("%s \"AUTOPROXY RegionFilters BYPASS Loopback %s %s %s\" with nil", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+				filters.Tracef(ctx, f.name, "RegionFilters", "%s resolves to loopback %s, bypass", host, ip)
 				f.RegionFilterCache.Set(host, nil, time.Now().Add(time.Hour))
 			} else if ip.To4() == nil {
 				if f1, ok := f.RegionFiltersRules["ipv6"]; ok {
 					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters IPv6 %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
+					filters.Tracef(ctx, f.name, "RegionFilters", "%s resolves to IPv6 %s, with %s", host, ip, f1.FilterName())
 					f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
 					filters.SetRoundTripFilter(ctx, f1)
 				}
 			} else if f1, ok := f.RegionFiltersIPRules[ip.String()]; ok {
 				glog.V(2).Infof("%s \"AUTOPROXY RegionFilters IPRules %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
+				filters.Tracef(ctx, f.name, "RegionFilters", "%s resolves to %s in IPRules, with %s", host, ip, f1.FilterName())
 				f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
 				filters.SetRoundTripFilter(ctx, f1)
 			} else if country, err := f.FindCountryByIP(ip.String()); err == nil {
 				if f1, ok := f.RegionFiltersRules[country]; ok {
 					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters %s %s %s %s\" with %T", req.RemoteAddr, country, req.Method, req.URL.String(), req.Proto, f1)
+					filters.Tracef(ctx, f.name, "RegionFilters", "%s resolves to %s in %s, with %s", host, ip, country, f1.FilterName())
 					f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
 					filters.SetRoundTripFilter(ctx, f1)
 				} else if f1, ok := f.RegionFiltersRules["default"]; ok {
 					glog.V(2).Infof("%s \"AUTOPROXY RegionFilters Default %s %s %s\" with %T", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, f1)
+					filters.Tracef(ctx, f.name, "RegionFilters", "%s resolves to %s in %s, with default %s", host, ip, country, f1.FilterName())
 					f.RegionFilterCache.Set(host, f1, time.Now().Add(time.Hour))
 					filters.SetRoundTripFilter(ctx, f1)
 				} else {
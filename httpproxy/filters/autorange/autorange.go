@@ -12,7 +12,6 @@ import (
 
 	"../../filters"
 	"../../helpers"
-	"../../storage"
 )
 
 const (
@@ -28,6 +27,7 @@ type Config struct {
 }
 
 type Filter struct {
+	name string
 	Config
 	SiteMatcher    *helpers.HostMatcher
 	SupportFilters map[string]struct{}
@@ -37,19 +37,24 @@ type Filter struct {
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
 		config := new(Config)
-		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		f.(*Filter).name = name
+		return f, nil
 	})
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
 	f := &Filter{
+		name:           filterName,
 		Config:         *config,
 		SiteMatcher:    helpers.NewHostMatcher(config.Sites),
 		SupportFilters: make(map[string]struct{}),
@@ -66,7 +71,18 @@ func NewFilter(config *Config) (filters.Filter, error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
+}
+
+// isSupportFilter reports whether name or, for an instance like "gae@hk",
+// its filter name is listed in SupportFilters.
+func (f *Filter) isSupportFilter(name string) bool {
+	if _, ok := f.SupportFilters[name]; ok {
+		return true
+	}
+	filterName, _ := filters.SplitName(name)
+	_, ok := f.SupportFilters[filterName]
+	return ok
 }
 
 func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
@@ -79,6 +95,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		case f.SiteMatcher.Match(req.Host):
 			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", 0, f.MaxSize))
 			glog.V(2).Infof("AUTORANGE Sites rule matched, add %s for\"%s\"", req.Header.Get("Range"), req.URL.String())
+			filters.Tracef(ctx, f.name, "Sites", "add Range %s", req.Header.Get("Range"))
 			ctx = filters.WithBool(ctx, "autorange.site", true)
 		default:
 			glog.V(3).Infof("AUTORANGE ignore preserved empty range for %#v", req.URL)
@@ -93,6 +110,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 				if end, err := strconv.Atoi(parts1[1]); err != nil || end-start > f.MaxSize {
 					req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+f.MaxSize))
 					glog.V(2).Infof("AUTORANGE Default rule matched, change %s to %s for\"%s\"", r, req.Header.Get("Range"), req.URL.String())
+					filters.Tracef(ctx, f.name, "Default", "change Range %s to %s", r, req.Header.Get("Range"))
 				}
 			}
 		default:
@@ -116,8 +134,9 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 	if f1 == nil {
 		return ctx, resp, nil
 	}
-	if _, ok := f.SupportFilters[f1.FilterName()]; !ok {
+	if !f.isSupportFilter(f1.FilterName()) {
 		glog.V(2).Infof("AUTORANGE hit a unsupported filter=%#v", f1)
+		filters.Tracef(ctx, f.name, "Response", "%s does not support rangefetch", f1.FilterName())
 		return ctx, resp, nil
 	}
 
@@ -146,6 +165,7 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 	}
 
 	glog.V(2).Infof("AUTORANGE respone matched, start rangefetch for %#v", resp.Header.Get("Content-Range"))
+	filters.Tracef(ctx, f.name, "Response", "rangefetch %s by %s with %d threads", resp.Header.Get("Content-Range"), f1.FilterName(), f.Threads)
 
 	resp.ContentLength = length
 	resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
@@ -15,7 +15,6 @@ import (
 	"../../filters"
 	"../../helpers"
 	"../../proxy"
-	"../../storage"
 )
 
 const (
@@ -47,20 +46,26 @@ type Config struct {
 }
 
 type Filter struct {
+	name string
 	Config
 	filters.RoundTripFilter
 	transport *http.Transport
+	dial      func(network, addr string) (net.Conn, error)
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
 		config := new(Config)
-		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		f.(*Filter).name = name
+		return f, nil
 	})
 }
 
@@ -98,11 +103,20 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		DisableCompression:  config.Transport.DisableCompression,
 	}
 
+	// CONNECT and Upgrade requests are tunneled through the proxy, even if
+	// the http.Transport sends the others to it directly
+	dial := d.Dial
 	if config.Transport.Proxy.Enabled {
 		fixedURL, err := url.Parse(config.Transport.Proxy.URL)
 		if err != nil {
-			glog.Fatalf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
+			return nil, fmt.Errorf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
+		}
+
+		dialer, err := proxy.FromURL(fixedURL, d, nil)
+		if err != nil {
+			return nil, fmt.Errorf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
 		}
+		dial = dialer.Dial
 
 		switch fixedURL.Scheme {
 		case "http", "https":
@@ -110,11 +124,6 @@ func NewFilter(config *Config) (filters.Filter, error) {
 			tr.Dial = nil
 			tr.DialTLS = nil
 		default:
-			dialer, err := proxy.FromURL(fixedURL, d, nil)
-			if err != nil {
-				glog.Fatalf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
-			}
-
 			tr.Dial = dialer.Dial
 			tr.DialTLS = nil
 			tr.Proxy = nil
@@ -122,20 +131,22 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	return &Filter{
+		name:      filterName,
 		Config:    *config,
 		transport: tr,
+		dial:      dial,
 	}, nil
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
 	switch req.Method {
 	case "CONNECT":
 		glog.V(2).Infof("%s \"DIRECT %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
-		rconn, err := f.transport.Dial("tcp", req.Host)
+		rconn, err := f.dial("tcp", req.Host)
 		if err != nil {
 			return ctx, nil, err
 		}
@@ -159,13 +170,23 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		if err != nil {
 			return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
 		}
+		lconn = filters.WrapTunnel(ctx, lconn)
 		defer lconn.Close()
+		defer rconn.Close()
 
-		go helpers.IOCopy(rconn, lconn)
+		go func() {
+			helpers.IOCopy(rconn, lconn)
+			rconn.Close()
+		}()
 		helpers.IOCopy(lconn, rconn)
 
 		return ctx, filters.DummyResponse, nil
 	default:
+		if filters.IsUpgrade(req) {
+			glog.V(2).Infof("%s \"DIRECT UPGRADE %s %s %s\" %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, req.Header.Get("Upgrade"))
+			return filters.RelayUpgrade(ctx, req, f.dial)
+		}
+
 		helpers.FixRequestURL(req)
 		helpers.FixRequestHeader(req)
 		resp, err := f.transport.RoundTrip(req)
@@ -0,0 +1,227 @@
+package filters
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../storage"
+)
+
+const (
+	// ErrorPageFilename is looked up in the httpproxy store, it overrides
+	// the builtin errorPageTemplate.
+	ErrorPageFilename string = "errorpage.html"
+)
+
+// The upstream error categories shown on error pages.
+const (
+	ErrorCategoryDNS              string = "DNS"
+	ErrorCategoryTLSHandshake     string = "TLS handshake"
+	ErrorCategoryOverQuota        string = "GAE over quota"
+	ErrorCategoryDeadlineExceeded string = "DEADLINE_EXCEEDED"
+	ErrorCategoryBlackListIP      string = "blacklisted IP"
+	ErrorCategoryTimeout          string = "timeout"
+	ErrorCategoryOther            string = "other"
+)
+
+const errorPageTemplate string = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.StatusText}}</title>
+<style>
+body { font-family: sans-serif; margin: 3em auto; max-width: 42em; color: #333; }
+h1 { font-size: 1.5em; }
+table { border-collapse: collapse; }
+td { padding: .2em 1em .2em 0; vertical-align: top; }
+td:first-child { color: #888; }
+pre { white-space: pre-wrap; word-break: break-all; }
+</style>
+</head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>The proxy could not get <b>{{.URL}}</b> from the upstream.</p>
+<table>
+<tr><td>Filter</td><td>{{.Filter}}</td></tr>
+<tr><td>Category</td><td>{{.Category}}</td></tr>
+{{if .AppID}}<tr><td>AppID</td><td>{{.AppID}}</td></tr>
+{{end}}{{if .IP}}<tr><td>IP</td><td>{{.IP}}</td></tr>
+{{end}}<tr><td>Error</td><td><pre>{{.Error}}</pre></td></tr>
+</table>
+{{if .RetryURL}}<p><a href="{{.RetryURL}}">Retry</a></p>
+{{end}}<hr>
+<address>{{.Software}} at {{.Host}}</address>
+</body>
+</html>
+`
+
+// ErrorInfo is the data of error pages.
+type ErrorInfo struct {
+	Status     int    `json:"-"`
+	StatusText string `json:"-"`
+	Type       string `json:"type"`
+	Host       string `json:"host"`
+	Software   string `json:"software"`
+	Filter     string `json:"filter"`
+	Category   string `json:"category"`
+	AppID      string `json:"appid,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	URL        string `json:"url,omitempty"`
+	RetryURL   string `json:"-"`
+	Error      string `json:"error"`
+}
+
+// NewErrorInfo collects the details of err for an error page of req, which
+// may be nil.
+func NewErrorInfo(ctx context.Context, req *http.Request, code int, err error) *ErrorInfo {
+	info := &ErrorInfo{
+		Status:     code,
+		StatusText: http.StatusText(code),
+		Type:       "localproxy",
+		Software:   fmt.Sprintf("%s (go/%s %s/%s)", GetBranding(ctx), runtime.Version(), runtime.GOOS, runtime.GOARCH),
+		Filter:     "<nil>",
+		Category:   ErrorCategory(err),
+		Error:      err.Error(),
+	}
+
+	if ln := GetListener(ctx); ln != nil {
+		info.Host = ln.Addr().String()
+	}
+
+	if f := GetRoundTripFilter(ctx); f != nil {
+		info.Filter = f.FilterName()
+	}
+
+	if req != nil && req.URL != nil {
+		info.URL = req.URL.String()
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			info.RetryURL = info.URL
+		}
+	}
+
+	switch e := unwrapError(err).(type) {
+	case *OverQuotaError:
+		info.AppID = strings.TrimSuffix(e.Upstream, ".appspot.com")
+	case *net.OpError:
+		if e.Addr != nil {
+			if host, _, err := net.SplitHostPort(e.Addr.String()); err == nil {
+				info.IP = host
+			}
+		}
+	}
+
+	return info
+}
+
+// ErrorCategory returns the category of an upstream error for error pages.
+func ErrorCategory(err error) string {
+	err = unwrapError(err)
+
+	switch e := err.(type) {
+	case *OverQuotaError:
+		return ErrorCategoryOverQuota
+	case *net.DNSError:
+		return ErrorCategoryDNS
+	case tls.RecordHeaderError, x509.CertificateInvalidError, x509.HostnameError, x509.UnknownAuthorityError:
+		return ErrorCategoryTLSHandshake
+	case *net.OpError:
+		if _, ok := e.Err.(*net.DNSError); ok {
+			return ErrorCategoryDNS
+		}
+	}
+
+	// the errors of GAE and MultiDialer are told by their messages
+	s := err.Error()
+	switch {
+	case strings.Contains(s, "DEADLINE_EXCEEDED"):
+		return ErrorCategoryDeadlineExceeded
+	case strings.Contains(s, "have no good ips"), strings.Contains(s, "Wrong certificate"):
+		return ErrorCategoryBlackListIP
+	case strings.Contains(s, "tls: "), strings.Contains(s, "x509: "):
+		return ErrorCategoryTLSHandshake
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrorCategoryTimeout
+	}
+
+	return ErrorCategoryOther
+}
+
+// ErrorResponse returns an error page of err for req, in HTML if the client
+// accepts text/html, or in JSON for the others. It may be returned by any
+// RoundTripFilter or ResponseFilter.
+func ErrorResponse(ctx context.Context, req *http.Request, code int, err error) *http.Response {
+	info := NewErrorInfo(ctx, req, code, err)
+
+	var b []byte
+	var contentType string
+
+	if req != nil && strings.Contains(req.Header.Get("Accept"), "text/html") {
+		var err1 error
+		if b, err1 = renderErrorPage(info); err1 != nil {
+			glog.Warningf("render %#v error: %+v", ErrorPageFilename, err1)
+		} else {
+			contentType = "text/html; charset=utf-8"
+		}
+	}
+
+	if contentType == "" {
+		b, _ = json.MarshalIndent(info, "", "    ")
+		b = append(b, '\n')
+		contentType = "application/json; charset=utf-8"
+	}
+
+	return &http.Response{
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":           []string{contentType},
+			"X-Content-Type-Options": []string{"nosniff"},
+		},
+		Request:       req,
+		ContentLength: int64(len(b)),
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+	}
+}
+
+func renderErrorPage(info *ErrorInfo) ([]byte, error) {
+	tpl := errorPageTemplate
+
+	store := storage.LookupStoreByFilterName("httpproxy")
+	if resp, err := store.Get(ErrorPageFilename); err == nil {
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tpl = string(data)
+	}
+
+	t, err := template.New("errorpage").Parse(tpl)
+	if err != nil {
+		return nil, err
+	}
+
+	b := new(bytes.Buffer)
+	if err := t.Execute(b, info); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,68 @@
+package filters
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// The classes of RoundTrip errors, which a profile may let fall through to
+// the next RoundTripFilter.
+const (
+	ErrorClassDial    string = "dial"
+	ErrorClassQuota   string = "quota"
+	ErrorClassTimeout string = "timeout"
+)
+
+// OverQuotaError is returned by a RoundTripFilter when all of its upstreams
+// are over quota.
+type OverQuotaError struct {
+	Filter   string
+	Upstream string
+	Err      error
+}
+
+func (e *OverQuotaError) Error() string {
+	return fmt.Sprintf("%s: all upstreams over quota, last %s: %v", e.Filter, e.Upstream, e.Err)
+}
+
+// UpgradeUnsupportedError is returned by a RoundTripFilter which cannot relay
+// Upgrade requests, the Handler passes them to the next RoundTripFilter.
+type UpgradeUnsupportedError struct {
+	Filter  string
+	Upgrade string
+}
+
+func (e *UpgradeUnsupportedError) Error() string {
+	return fmt.Sprintf("%s: upgrade to %#v is not supported", e.Filter, e.Upgrade)
+}
+
+// ErrorClass returns the class of a RoundTrip error, or "" if it belongs to
+// none of them.
+func ErrorClass(err error) string {
+	err = unwrapError(err)
+
+	switch e := err.(type) {
+	case *OverQuotaError:
+		return ErrorClassQuota
+	case *net.OpError:
+		if e.Op == "dial" {
+			return ErrorClassDial
+		}
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrorClassTimeout
+	}
+
+	return ""
+}
+
+// unwrapError returns the error of a http.Client, which wraps the errors of
+// the Transport.
+func unwrapError(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		return ue.Err
+	}
+	return err
+}
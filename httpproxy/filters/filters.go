@@ -2,8 +2,12 @@ package filters
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"strings"
 	"sync"
+
+	"../storage"
 )
 
 var (
@@ -30,14 +34,66 @@ type ResponseFilter interface {
 	Response(context.Context, *http.Response) (context.Context, *http.Response, error)
 }
 
+// A HijackFilter is a ResponseFilter which is also told about the requests
+// that a RoundTripFilter served itself over the hijacked connection, like
+// CONNECT tunnels. Those return DummyResponse and never reach Response.
+type HijackFilter interface {
+	ResponseFilter
+	Hijacked(ctx context.Context, req *http.Request, bytesIn, bytesOut int64)
+}
+
+// A Starter is a Filter which runs in background. Start is called once the
+// filter is in use, that is, after the handlers which refer to it have been
+// swapped in, so that a filter built by a failed reload never starts.
+type Starter interface {
+	Start()
+}
+
+// A Stopper is a Filter whose background work can be stopped, usually a
+// Starter. Stop is called when the filter is replaced by a reload or on
+// shutdown, and returns when the background work has finished up.
+type Stopper interface {
+	Stop()
+}
+
 var (
 	mu  = new(sync.Mutex)
 	mm  = make(map[string]*sync.Mutex)
-	fnm = make(map[string]func() (Filter, error))
+	fnm = make(map[string]func(name string) (Filter, error))
 	fm  = make(map[string]Filter)
+	fcm = make(map[string]func() interface{})
+	sm  = make(map[string]Filter)
+
+	// started is set once Start has been called, so that GetFilter starts
+	// the instances which it builds later, unless a Reset is pending.
+	started   bool
+	resetting bool
 )
 
-func Register(name string, New func() (Filter, error)) {
+// A ConfigValidator is a filter config which can tell its errors that the
+// JSON decoding does not catch, like conflicting options.
+type ConfigValidator interface {
+	Validate() []error
+}
+
+// A ConfigReferrer is a filter config which refers to other filters by
+// their instance names.
+type ConfigReferrer interface {
+	ReferredFilters() []string
+}
+
+// A ConfigMerger is a filter config which merges some of its options into
+// others when the filter is built. MergeConfig does the merge, and returns the
+// merged options mapped to the options their values come from, in order of
+// precedence.
+type ConfigMerger interface {
+	MergeConfig() map[string][]string
+}
+
+// Register makes a filter constructor available by name. New is called with
+// the name passed to GetFilter, which is either the filter name itself or an
+// instance name like "gae@hk", see ReadConfig.
+func Register(name string, New func(name string) (Filter, error)) {
 	mu.Lock()
 	defer mu.Unlock()
 	if _, ok := fnm[name]; !ok {
@@ -47,26 +103,282 @@ func Register(name string, New func() (Filter, error)) {
 	}
 }
 
+// RegisterConfig makes the config type of a filter available by name, so that
+// CheckConfig can validate its config files without building the filter.
+func RegisterConfig(name string, New func() interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	fcm[name] = New
+}
+
+// SplitName splits an instance name like "gae@hk" into its filter name and
+// instance, the instance of a plain filter name is empty.
+func SplitName(name string) (filterName, instance string) {
+	if i := strings.Index(name, "@"); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// ReadConfig unmarshals the config of filter instance name into config. For
+// an instance like "gae@hk", gae@hk.json is layered over gae.json, so that
+// the instance config only needs the fields which differ.
+func ReadConfig(name string, config interface{}) error {
+	filterName, instance := SplitName(name)
+
+	store := storage.LookupStoreByFilterName(filterName)
+
+	filename := filterName + ".json"
+	if err := store.UnmarshallJson(filename, config); err != nil {
+		return fmt.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	if instance == "" {
+		return nil
+	}
+
+	filename = name + ".json"
+	if err := store.UnmarshallJson(filename, config); err != nil {
+		return fmt.Errorf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	return nil
+}
+
+// CheckConfig validates the config files of filter instance name like
+// ReadConfig reads them, and returns the decoded config, or nil if they
+// cannot be decoded.
+func CheckConfig(name string) (interface{}, []error) {
+	filterName, instance := SplitName(name)
+
+	mu.Lock()
+	New := fcm[filterName]
+	mu.Unlock()
+
+	if New == nil {
+		return nil, []error{fmt.Errorf("filters: unknown filter %#v", name)}
+	}
+
+	store := storage.LookupStoreByFilterName(filterName)
+	config := New()
+
+	filename := filterName + ".json"
+	errs, ok := storage.CheckJson(store, filename, config)
+	if instance != "" {
+		filename = name + ".json"
+		errs1, ok1 := storage.CheckJson(store, filename, config)
+		errs, ok = append(errs, errs1...), ok && ok1
+	}
+	if !ok {
+		return nil, errs
+	}
+
+	if v, ok := config.(ConfigValidator); ok {
+		for _, err := range v.Validate() {
+			errs = append(errs, &storage.ConfigError{Filename: storage.Path(store, filename), Err: err})
+		}
+	}
+
+	return config, errs
+}
+
+// DumpConfig returns the effective config of filter instance name, as the
+// filter is built from it, with its secrets redacted and the sources of its
+// values. The decoded config is returned as well.
+func DumpConfig(name string) (interface{}, *storage.Dump, error) {
+	filterName, instance := SplitName(name)
+
+	mu.Lock()
+	New := fcm[filterName]
+	mu.Unlock()
+
+	if New == nil {
+		return nil, nil, fmt.Errorf("filters: unknown filter %#v", name)
+	}
+
+	store := storage.LookupStoreByFilterName(filterName)
+	config := New()
+
+	filenames := []string{filterName + ".json"}
+	if instance != "" {
+		filenames = append(filenames, name+".json")
+	}
+
+	sources, err := storage.MergeJson(store, config, filenames...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("storage.MergeJson(%#v) failed: %s", filenames, err)
+	}
+
+	var aliases map[string][]string
+	if m, ok := config.(ConfigMerger); ok {
+		aliases = m.MergeConfig()
+	}
+
+	dump, err := storage.NewDump(config, sources, aliases)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return config, dump, nil
+}
+
 func GetFilter(name string) (Filter, error) {
-	if f, ok := fm[name]; ok && f != nil {
+	filterName, _ := SplitName(name)
+
+	mu.Lock()
+	f, New := fm[name], fnm[filterName]
+	fmu, ok := mm[name]
+	if New != nil && !ok {
+		fmu = new(sync.Mutex)
+		mm[name] = fmu
+	}
+	mu.Unlock()
+
+	if f != nil {
 		return f, nil
 	}
 
-	mu := mm[name]
+	if New == nil {
+		return nil, fmt.Errorf("filters: unknown filter %#v", name)
+	}
+
+	fmu.Lock()
+	defer fmu.Unlock()
+
 	mu.Lock()
-	defer mu.Unlock()
+	f = fm[name]
+	mu.Unlock()
 
-	if f, ok := fm[name]; ok && f != nil {
+	if f != nil {
 		return f, nil
 	}
 
-	f, err := fnm[name]()
+	f, err := New(name)
 	if err != nil {
 		return nil, err
 	}
 
+	mu.Lock()
 	fm[name] = f
+	f1, start := f.(Starter)
+	if start = start && started && !resetting; start {
+		sm[name] = f
+	}
+	mu.Unlock()
+
+	if start {
+		f1.Start()
+	}
 
 	return f, nil
+}
+
+// Filters returns the filter instances which GetFilter has built so far,
+// keyed by their instance names.
+func Filters() map[string]Filter {
+	mu.Lock()
+	defer mu.Unlock()
+
+	m := make(map[string]Filter, len(fm))
+	for name, f := range fm {
+		if f != nil {
+			m[name] = f
+		}
+	}
+
+	return m
+}
+
+// Start starts the Starters among the filter instances which GetFilter has
+// built, unless they have been started already.
+func Start() {
+	mu.Lock()
+	started = true
+	starters := make([]Starter, 0)
+	for name, f := range fm {
+		f1, ok := f.(Starter)
+		if !ok {
+			continue
+		}
+		if _, ok := sm[name]; ok {
+			continue
+		}
+		sm[name] = f
+		starters = append(starters, f1)
+	}
+	mu.Unlock()
+
+	for _, f := range starters {
+		f.Start()
+	}
+}
+
+// Stop stops all started filter instances which are Stoppers, for shutdown.
+func Stop() {
+	mu.Lock()
+	started = false
+	fs := make([]Filter, 0, len(sm))
+	for name, f := range sm {
+		fs = append(fs, f)
+		delete(sm, name)
+	}
+	mu.Unlock()
+
+	stopFilters(fs)
+}
+
+func stopFilters(fs []Filter) {
+	for _, f := range fs {
+		if f1, ok := f.(Stopper); ok {
+			f1.Stop()
+		}
+	}
+}
+
+// Reset drops all cached filter instances, so the next GetFilter call of each
+// filter builds a new one from its current config. Once the new instances are
+// in use, commit stops the dropped ones and starts the new ones, and the ones
+// which GetFilter builds afterwards are started as they are built. For callers
+// whose rebuild has failed, restore instead drops the new instances and puts
+// the dropped ones back, which keep running.
+func Reset() (commit func(), restore func()) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	fm0 := fm
+	fm = make(map[string]Filter, len(fm0))
+	resetting = true
+
+	commit = func() {
+		mu.Lock()
+		resetting = false
+		fs := make([]Filter, 0)
+		for name, f := range sm {
+			if fm[name] != f {
+				fs = append(fs, f)
+				delete(sm, name)
+			}
+		}
+		mu.Unlock()
+
+		stopFilters(fs)
+		Start()
+	}
+
+	restore = func() {
+		mu.Lock()
+		fs := make([]Filter, 0)
+		for name, f := range fm {
+			if fm0[name] != f {
+				fs = append(fs, f)
+			}
+		}
+		fm = fm0
+		resetting = false
+		mu.Unlock()
+
+		stopFilters(fs)
+	}
 
+	return commit, restore
 }
@@ -2,8 +2,12 @@ package filters
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,10 +20,27 @@ type racer struct {
 	rw  http.ResponseWriter
 	rtf RoundTripFilter
 	b   string
+	t   time.Time
+
+	mu    sync.Mutex
+	trace []TraceEntry
+	wrap  func(net.Conn) net.Conn
+	fall  func(error) bool
+}
+
+// TraceEntry is a decision which a filter made about the route of a request.
+type TraceEntry struct {
+	Filter string
+	Event  string
+	Detail string
+}
+
+func (e TraceEntry) String() string {
+	return fmt.Sprintf("%s %s: %s", e.Filter, e.Event, e.Detail)
 }
 
 func NewContext(ctx context.Context, h http.Handler, ln net.Listener, rw http.ResponseWriter, brand string) context.Context {
-	return context.WithValue(ctx, contextKey, &racer{h, ln, rw, nil, brand})
+	return context.WithValue(ctx, contextKey, &racer{h: h, ln: ln, rw: rw, b: brand, t: time.Now()})
 }
 
 func GetHandler(ctx context.Context) http.Handler {
@@ -42,10 +63,101 @@ func GetBranding(ctx context.Context) string {
 	return ctx.Value(contextKey).(*racer).b
 }
 
+// GetStartTime returns the time when the Handler started to serve the request.
+func GetStartTime(ctx context.Context) time.Time {
+	return ctx.Value(contextKey).(*racer).t
+}
+
 func SetRoundTripFilter(ctx context.Context, filter RoundTripFilter) {
 	ctx.Value(contextKey).(*racer).rtf = filter
 }
 
+// SetFallthrough sets the func which reports whether the Handler lets an
+// error of the current RoundTripFilter fall through to the next one, a nil
+// match lets none of them.
+func SetFallthrough(ctx context.Context, match func(error) bool) {
+	if r, ok := ctx.Value(contextKey).(*racer); ok {
+		r.fall = match
+	}
+}
+
+// Fallthrough reports whether the Handler lets err fall through to the next
+// RoundTripFilter, so that a RoundTripFilter could return err instead of the
+// error response which the client would get otherwise.
+func Fallthrough(ctx context.Context, err error) bool {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok || r.fall == nil {
+		return false
+	}
+
+	return r.fall(err)
+}
+
+// AddTunnelWrapper makes WrapTunnel wrap connections with wrap, after the
+// wrappers added before.
+func AddTunnelWrapper(ctx context.Context, wrap func(net.Conn) net.Conn) {
+	r := ctx.Value(contextKey).(*racer)
+	if r.wrap == nil {
+		r.wrap = wrap
+		return
+	}
+
+	wrap0 := r.wrap
+	r.wrap = func(conn net.Conn) net.Conn {
+		return wrap(wrap0(conn))
+	}
+}
+
+// WrapTunnel wraps the hijacked client connection of a tunnel, so that
+// RequestFilters could apply to the tunneled bytes, like rate limits.
+func WrapTunnel(ctx context.Context, conn net.Conn) net.Conn {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok || r.wrap == nil {
+		return conn
+	}
+
+	return r.wrap(conn)
+}
+
+// Tracef appends a decision of filter to the trace of the request, it does
+// nothing for contexts which are not made by NewContext.
+func Tracef(ctx context.Context, filter, event, format string, a ...interface{}) {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	r.trace = append(r.trace, TraceEntry{filter, event, fmt.Sprintf(format, a...)})
+	r.mu.Unlock()
+}
+
+// GetTrace returns the decisions recorded by Tracef so far.
+func GetTrace(ctx context.Context) []TraceEntry {
+	r, ok := ctx.Value(contextKey).(*racer)
+	if !ok {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]TraceEntry(nil), r.trace...)
+}
+
+// FormatTrace returns the trace of the request in one line, as used by the
+// X-GoProxy-Trace header.
+func FormatTrace(ctx context.Context) string {
+	trace := GetTrace(ctx)
+
+	parts := make([]string, len(trace))
+	for i, e := range trace {
+		parts[i] = e.String()
+	}
+
+	return strings.Join(parts, "; ")
+}
+
 func WithString(ctx context.Context, name, value string) context.Context {
 	return context.WithValue(ctx, name, value)
 }
@@ -8,18 +8,20 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"flag"
+	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/dsnet/compress/brotli"
+	gscan "github.com/out0fmemory/gscan_quic"
 	"github.com/phuslu/glog"
 	"github.com/phuslu/net/http2"
-	gscan "github.com/out0fmemory/gscan_quic"
 	quic "github.com/phuslu/quic-go"
 	"github.com/phuslu/quic-go/h2quic"
 
@@ -37,8 +39,9 @@ type Config struct {
 	AppIDs          []string
 	CustomDomains   []string
 	Password        string
-	AutoScanIp	bool
-	AutoScanIpCnt	int
+	ServerStrategy  string
+	AutoScanIp      bool
+	AutoScanIpCnt   int
 	SSLVerify       bool
 	DisableIPv6     bool
 	ForceIPv6       bool
@@ -64,7 +67,27 @@ type Config struct {
 	FakeOptions map[string][]string
 	DNSServers  []string
 	IPBlackList []string
-	Transport   struct {
+	IPScanner   struct {
+		Enabled     bool
+		Aliases     []string
+		RangeFile   string
+		MinGoodIPs  int
+		MaxNewIPs   int
+		MaxProbes   int
+		Concurrency int
+		Rate        int
+		Timeout     int
+		Interval    int
+	}
+	IPState struct {
+		File     string
+		Interval int
+	}
+	Quota struct {
+		CheckInterval int
+		ProbeURL      string
+	}
+	Transport struct {
 		Dialer struct {
 			DNSCacheExpiry   int
 			DNSCacheSize     uint
@@ -88,6 +111,7 @@ type Config struct {
 }
 
 type Filter struct {
+	name string
 	Config
 	GAETransport       *GAETransport
 	Transport          *Transport
@@ -99,21 +123,187 @@ type Filter struct {
 	FakeOptionsMatcher *helpers.HostMatcher
 	SiteMatcher        *helpers.HostMatcher
 	DirectSiteMatcher  *helpers.HostMatcher
+	IPScanner          *helpers.IPScanner
+
+	deadProbe func(ctx context.Context)
+	stop      func()
 }
 
+var (
+	autoScanOnce sync.Once
+	autoScanIPs  []string
+)
+
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
 		config := new(Config)
-		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		f.(*Filter).name = name
+		f.(*Filter).GAETransport.Name = name
+		return f, nil
 	})
 }
 
+// Start runs the IPScanner, the IP state snapshots, the quota checks and the
+// dead probe of the filter in background. The IP state is restored here,
+// which is after the instance which the filter replaces on reload has saved
+// its last snapshot.
+func (f *Filter) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	goWait := func(run func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run()
+		}()
+	}
+
+	md := f.GAETransport.MultiDialer
+	if md != nil && f.Config.IPState.File != "" && f.Config.IPState.Interval > 0 {
+		store := storage.LookupStoreByFilterName(filterName)
+		filename := ipStateFile(f.name, f.Config.IPState.File)
+		loadIPStates(store, filename, md)
+		goWait(func() {
+			saveIPStatesEvery(ctx, store, filename, md, time.Duration(f.Config.IPState.Interval)*time.Second)
+		})
+	}
+
+	if f.IPScanner != nil {
+		goWait(func() { f.IPScanner.Run(ctx) })
+	}
+
+	if f.deadProbe != nil {
+		goWait(func() { f.deadProbe(ctx) })
+	}
+
+	if f.Config.Quota.CheckInterval > 0 {
+		goWait(func() {
+			f.GAETransport.CheckQuota(ctx, time.Duration(f.Config.Quota.CheckInterval)*time.Second, f.Config.Quota.ProbeURL)
+		})
+	}
+
+	f.stop = func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// Stop stops the background jobs of the filter, and saves its IP states.
+func (f *Filter) Stop() {
+	if f.stop != nil {
+		f.stop()
+		f.stop = nil
+	}
+}
+
+// Validate reports the unsupported values and the conflicting options, which
+// all of NewFilter would otherwise refuse one at a time.
+func (c *Config) Validate() []error {
+	var errs []error
+
+	if len(c.AppIDs) > 0 && len(c.CustomDomains) > 0 {
+		errs = append(errs, fmt.Errorf("GAE AppIDs and CustomDomains is conflict!"))
+	}
+
+	for _, name := range c.TLSConfig.Ciphers {
+		if helpers.TLSCipher(name) == 0 {
+			errs = append(errs, fmt.Errorf("GAE: cipher %#v is not supported.", name))
+		}
+	}
+
+	for _, pkp := range []string{c.GoogleG2PKP, c.GoogleG3PKP} {
+		if _, err := base64.StdEncoding.DecodeString(pkp); err != nil {
+			errs = append(errs, fmt.Errorf("GAE: base64 decode PKP %#v error: %v", pkp, err))
+		}
+	}
+
+	if c.EnableRemoteDNS && (len(c.DNSServers) == 0 || net.ParseIP(c.DNSServers[0]) == nil) {
+		errs = append(errs, fmt.Errorf("GAE: EnableRemoteDNS needs an IP in DNSServers, got %#v", c.DNSServers))
+	}
+
+	if c.DisableHTTP2 && c.ForceHTTP2 {
+		errs = append(errs, fmt.Errorf("GAE: DisableHTTP2=%v and ForceHTTP2=%v is conflict!", c.DisableHTTP2, c.ForceHTTP2))
+	}
+
+	if c.Transport.Proxy.Enabled {
+		if c.EnableQuic {
+			errs = append(errs, fmt.Errorf("EnableQuic is conflict with Proxy setting!"))
+		}
+		if c.ForceHTTP2 && !c.EnableQuic {
+			errs = append(errs, fmt.Errorf("GAE: Proxy.Enabled=%v and ForceHTTP2=%v is conflict!", c.Transport.Proxy.Enabled, c.ForceHTTP2))
+		}
+		if _, err := url.Parse(c.Transport.Proxy.URL); err != nil {
+			errs = append(errs, fmt.Errorf("url.Parse(%#v) error: %s", c.Transport.Proxy.URL, err))
+		}
+	}
+
+	switch c.ServerStrategy {
+	case "", StrategySticky, StrategyLatency, StrategyWeighted:
+	default:
+		errs = append(errs, fmt.Errorf("GAE: unsupported ServerStrategy %#v, should be %#v, %#v or %#v", c.ServerStrategy, StrategySticky, StrategyLatency, StrategyWeighted))
+	}
+
+	if c.Quota.CheckInterval < 0 {
+		errs = append(errs, fmt.Errorf("GAE: Quota CheckInterval should not be negative"))
+	}
+	if c.Quota.ProbeURL != "" {
+		if u, err := url.Parse(c.Quota.ProbeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("GAE: Quota ProbeURL %#v should be a http or https URL", c.Quota.ProbeURL))
+		}
+	}
+
+	if c.IPState.File != "" && c.IPState.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("GAE: IPState Interval should be positive"))
+	}
+
+	if sc := c.IPScanner; sc.Enabled {
+		if sc.MinGoodIPs <= 0 || sc.MaxNewIPs <= 0 || sc.MaxProbes <= 0 {
+			errs = append(errs, fmt.Errorf("GAE: IPScanner MinGoodIPs, MaxNewIPs and MaxProbes should be positive"))
+		}
+		if sc.Concurrency <= 0 || sc.Rate <= 0 || sc.Timeout <= 0 || sc.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("GAE: IPScanner Concurrency, Rate, Timeout and Interval should be positive"))
+		}
+		for _, alias := range sc.Aliases {
+			if _, ok := c.HostMap[alias]; !ok {
+				errs = append(errs, fmt.Errorf("GAE: IPScanner alias %#v is not in HostMap", alias))
+			}
+		}
+	}
+
+	return errs
+}
+
+// MergeConfig merges SiteToAlias into the legacy Site2Alias, and makes both
+// of them the merged aliases.
+func (c *Config) MergeConfig() map[string][]string {
+	if c.Site2Alias == nil {
+		c.Site2Alias = make(map[string]string)
+	}
+	for key, value := range c.SiteToAlias {
+		c.Site2Alias[key] = value
+	}
+	c.SiteToAlias = c.Site2Alias
+
+	return map[string][]string{
+		"SiteToAlias": {"SiteToAlias", "Site2Alias"},
+		"Site2Alias":  {"SiteToAlias", "Site2Alias"},
+	}
+}
+
 func NewFilter(config *Config) (filters.Filter, error) {
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
 	dnsServers := make([]net.IP, 0)
 	for _, s := range config.DNSServers {
 		if ip := net.ParseIP(s); ip != nil {
@@ -162,21 +352,18 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	} else {
 		googleTLSConfig.MinVersion = tls.VersionTLS12
 	}
-	pickupCiphers := func(names []string) []uint16 {
-		ciphers := make([]uint16, 0)
-		for _, name := range names {
-			cipher := helpers.TLSCipher(name)
-			if cipher == 0 {
-				glog.Fatalf("GAE: cipher %#v is not supported.", name)
-			}
-			ciphers = append(ciphers, cipher)
+	ciphers := make([]uint16, 0)
+	for _, name := range config.TLSConfig.Ciphers {
+		cipher := helpers.TLSCipher(name)
+		if cipher == 0 {
+			return nil, fmt.Errorf("GAE: cipher %#v is not supported.", name)
 		}
-		rand.Shuffle(len(ciphers), func(i int, j int) {
-			ciphers[i], ciphers[j] = ciphers[j], ciphers[i]
-		})
-		return ciphers
+		ciphers = append(ciphers, cipher)
 	}
-	googleTLSConfig.CipherSuites = pickupCiphers(config.TLSConfig.Ciphers)
+	rand.Shuffle(len(ciphers), func(i int, j int) {
+		ciphers[i], ciphers[j] = ciphers[j], ciphers[i]
+	})
+	googleTLSConfig.CipherSuites = ciphers
 	if len(config.TLSConfig.ServerName) > 0 {
 		googleTLSConfig.ServerName = config.TLSConfig.ServerName[rand.Intn(len(config.TLSConfig.ServerName))]
 	}
@@ -184,28 +371,26 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		googleTLSConfig.NextProtos = []string{"h2", "http/1.1"}
 	}
 
-	if config.Site2Alias == nil {
-		config.Site2Alias = make(map[string]string)
-	}
-	for key, value := range config.SiteToAlias {
-		config.Site2Alias[key] = value
-	}
-	config.SiteToAlias = config.Site2Alias
+	config.MergeConfig()
 
 	hostmap := map[string][]string{}
-	
+
 	ipsarray := []string{}
 	if config.AutoScanIp == true {
-		ipbyte := gscan.Gscan(config.AutoScanIpCnt, false)
-		ipstring := string(ipbyte[:])
-		ipstringtrim := strings.Replace(ipstring, "\n", "",-1)
-		ipstringtrim = strings.Replace(ipstringtrim, "\"", "",-1)
-		ipsarray = strings.Split(ipstringtrim, ",")
+		// scan only once per process, a reload must not block on it
+		autoScanOnce.Do(func() {
+			ipbyte := gscan.Gscan(config.AutoScanIpCnt, false)
+			ipstring := string(ipbyte[:])
+			ipstringtrim := strings.Replace(ipstring, "\n", "", -1)
+			ipstringtrim = strings.Replace(ipstringtrim, "\"", "", -1)
+			autoScanIPs = strings.Split(ipstringtrim, ",")
+		})
+		ipsarray = autoScanIPs
 	}
 	for key, value := range config.HostMap {
 		mergehost := make([]string, len(ipsarray)+len(value))
-        	copy(mergehost, ipsarray)
-        	copy(mergehost[len(ipsarray):], value)
+		copy(mergehost, ipsarray)
+		copy(mergehost[len(ipsarray):], value)
 		hosts := helpers.UniqueStrings(mergehost)
 		rand.Shuffle(len(hosts), func(i int, j int) {
 			hosts[i], hosts[j] = hosts[j], hosts[i]
@@ -223,7 +408,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	if config.EnableRemoteDNS {
 		r.DNSServer = net.ParseIP(config.DNSServers[0])
 		if r.DNSServer == nil {
-			glog.Fatalf("net.ParseIP(%+v) failed: %s", config.DNSServers[0], err)
+			return nil, fmt.Errorf("net.ParseIP(%+v) failed: %s", config.DNSServers[0], err)
 		}
 	}
 
@@ -285,11 +470,11 @@ func NewFilter(config *Config) (filters.Filter, error) {
 
 	if config.Transport.Proxy.Enabled {
 		if config.EnableQuic {
-			glog.Fatalf("EnableQuic is conflict with Proxy setting!")
+			return nil, fmt.Errorf("EnableQuic is conflict with Proxy setting!")
 		}
 		fixedURL, err := url.Parse(config.Transport.Proxy.URL)
 		if err != nil {
-			glog.Fatalf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
+			return nil, fmt.Errorf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
 		}
 
 		dialer0 := &net.Dialer{
@@ -300,7 +485,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 
 		dialer, err := proxy.FromURL(fixedURL, dialer0, &helpers.MultiResolver{md})
 		if err != nil {
-			glog.Fatalf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
+			return nil, fmt.Errorf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
 		}
 
 		t1.Dial = dialer.Dial
@@ -327,9 +512,9 @@ func NewFilter(config *Config) (filters.Filter, error) {
 			GetClientKey:          GetHostnameCacheKey,
 		}
 	case config.DisableHTTP2 && config.ForceHTTP2:
-		glog.Fatalf("GAE: DisableHTTP2=%v and ForceHTTP2=%v is conflict!", config.DisableHTTP2, config.ForceHTTP2)
+		return nil, fmt.Errorf("GAE: DisableHTTP2=%v and ForceHTTP2=%v is conflict!", config.DisableHTTP2, config.ForceHTTP2)
 	case config.Transport.Proxy.Enabled && config.ForceHTTP2:
-		glog.Fatalf("GAE: Proxy.Enabled=%v and ForceHTTP2=%v is conflict!", config.Transport.Proxy.Enabled, config.ForceHTTP2)
+		return nil, fmt.Errorf("GAE: Proxy.Enabled=%v and ForceHTTP2=%v is conflict!", config.Transport.Proxy.Enabled, config.ForceHTTP2)
 	case config.ForceHTTP2:
 		tr.RoundTripper = &http2.Transport{
 			DialTLS:            md.DialTLS2,
@@ -368,6 +553,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		}
 	}
 
+	var deadProbe func(ctx context.Context)
 	if config.EnableDeadProbe && !config.Transport.Proxy.Enabled {
 		isNetAvailable := func() bool {
 			c, err := net.DialTimeout("tcp", net.JoinHostPort(config.DNSServers[0], "53"), 300*time.Millisecond)
@@ -379,13 +565,13 @@ func NewFilter(config *Config) (filters.Filter, error) {
 			return true
 		}
 
-		probeTLS := func() {
+		probeTLS := func(ctx context.Context) {
 			if !isNetAvailable() {
 				return
 			}
 
 			req, _ := http.NewRequest(http.MethodGet, "https://clients3.google.com/generate_204", nil)
-			ctx, cancel := context.WithTimeout(req.Context(), 2*time.Second)
+			ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 			defer cancel()
 			req = req.WithContext(ctx)
 			resp, err := tr.RoundTrip(req)
@@ -401,13 +587,13 @@ func NewFilter(config *Config) (filters.Filter, error) {
 			}
 		}
 
-		probeQuic := func() {
+		probeQuic := func(ctx context.Context) {
 			if !isNetAvailable() {
 				return
 			}
 
 			req, _ := http.NewRequest(http.MethodGet, "https://clients3.google.com/generate_204", nil)
-			resp, err := tr.RoundTrip(req)
+			resp, err := tr.RoundTrip(req.WithContext(ctx))
 			if resp != nil && resp.Body != nil {
 				resp.Body.Close()
 			}
@@ -423,22 +609,35 @@ func NewFilter(config *Config) (filters.Filter, error) {
 
 		}
 
-		go func() {
-			time.Sleep(1 * time.Minute)
+		deadProbe = func(ctx context.Context) {
+			sleep := func(d time.Duration) bool {
+				t := time.NewTimer(d)
+				defer t.Stop()
+				select {
+				case <-ctx.Done():
+					return false
+				case <-t.C:
+					return true
+				}
+			}
+
+			if !sleep(1 * time.Minute) {
+				return
+			}
 			for {
 				if config.EnableQuic {
-					time.Sleep(time.Duration(2+rand.Intn(2)) * time.Second)
-					probeQuic()
+					if !sleep(time.Duration(2+rand.Intn(2)) * time.Second) {
+						return
+					}
+					probeQuic(ctx)
 				} else {
-					time.Sleep(time.Duration(2+rand.Intn(4)) * time.Second)
-					probeTLS()
+					if !sleep(time.Duration(2+rand.Intn(4)) * time.Second) {
+						return
+					}
+					probeTLS(ctx)
 				}
 			}
-		}()
-	}
-
-	if len(config.AppIDs) > 0 && len(config.CustomDomains) > 0 {
-		glog.Fatalf("GAE AppIDs and CustomDomains is conflict!")
+		}
 	}
 
 	urls := []url.URL{}
@@ -459,11 +658,13 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	})
 
 	f := &Filter{
+		name:   filterName,
 		Config: *config,
 		GAETransport: &GAETransport{
+			Name:        filterName,
 			Transport:   tr,
 			MultiDialer: md,
-			Servers:     NewServers(urls, config.Password, config.SSLVerify),
+			Servers:     NewServers(urls, config.Password, config.SSLVerify, config.ServerStrategy),
 			Deadline:    time.Duration(config.Transport.ResponseHeaderTimeout-2) * time.Second,
 			RetryDelay:  time.Duration(config.Transport.RetryDelay*1000) * time.Millisecond,
 			RetryTimes:  config.Transport.RetryTimes,
@@ -476,17 +677,47 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		ForceGAESuffixs:    forceGAESuffixs,
 		FakeOptionsMatcher: helpers.NewHostMatcherWithStrings(config.FakeOptions),
 		DirectSiteMatcher:  helpers.NewHostMatcherWithString(config.Site2Alias),
+		deadProbe:          deadProbe,
 	}
 
 	if config.Transport.Proxy.Enabled {
 		f.GAETransport.MultiDialer = nil
 	}
 
+	if config.IPScanner.Enabled && !config.Transport.Proxy.Enabled {
+		store := storage.LookupStoreByFilterName(filterName)
+		resp, err := store.Get(config.IPScanner.RangeFile)
+		if err != nil {
+			return nil, fmt.Errorf("GAE: store.Get(%#v) error: %v", config.IPScanner.RangeFile, err)
+		}
+		defer resp.Body.Close()
+
+		ranges, err := helpers.ParseIPRanges(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("GAE: ParseIPRanges(%#v) error: %v", config.IPScanner.RangeFile, err)
+		}
+
+		f.IPScanner = &helpers.IPScanner{
+			MultiDialer: md,
+			Aliases:     config.IPScanner.Aliases,
+			Ranges:      ranges,
+			Port:        "443",
+			TLSConfig:   md.GoogleTLSConfig,
+			MinGoodIPs:  config.IPScanner.MinGoodIPs,
+			MaxNewIPs:   config.IPScanner.MaxNewIPs,
+			MaxProbes:   config.IPScanner.MaxProbes,
+			Concurrency: config.IPScanner.Concurrency,
+			Rate:        config.IPScanner.Rate,
+			Timeout:     time.Duration(config.IPScanner.Timeout) * time.Second,
+			Interval:    time.Duration(config.IPScanner.Interval) * time.Second,
+		}
+	}
+
 	return f, nil
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
@@ -496,6 +727,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		if !strings.HasPrefix(req.Header.Get("Referer"), "https://") {
 			u := strings.Replace(req.URL.String(), "http://", "https://", 1)
 			glog.V(2).Infof("GAE FORCEHTTPS get raw url=%v, redirect to %v", req.URL.String(), u)
+			filters.Tracef(ctx, f.name, "ForceHTTPS", "redirect to %s", u)
 			resp := &http.Response{
 				StatusCode: http.StatusMovedPermanently,
 				Header: http.Header{
@@ -553,6 +785,9 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 					req.Header.Set("Connection", s1)
 				}
 			}
+			filters.Tracef(ctx, f.name, "DirectSiteMatcher", "%s direct to google", req.Host)
+		} else {
+			filters.Tracef(ctx, f.name, "DirectSiteMatcher", "%s matched, but %s or ForceGAE, via fetch servers", req.Host, req.URL.Scheme)
 		}
 	}
 
@@ -582,27 +817,16 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		}
 	}
 
-	if tr == f.GAETransport {
-		switch strings.ToLower(req.Header.Get("Connection")) {
-		case "upgrade":
-			resp := &http.Response{
-				StatusCode: http.StatusForbidden,
-				Header: http.Header{
-					"X-WebSocket-Reject-Reason": []string{"Unsupported"},
-				},
-				Request:       req,
-				Close:         true,
-				ContentLength: 0,
-			}
-			glog.V(2).Infof("%s \"GAE FAKEWEBSOCKET %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
-			return ctx, resp, nil
-		}
+	if filters.IsUpgrade(req) {
+		glog.V(2).Infof("%s \"GAE UPGRADE %s %s %s\" unsupported", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+		return ctx, nil, &filters.UpgradeUnsupportedError{Filter: f.name, Upgrade: req.Header.Get("Upgrade")}
 	}
 
 	prefix := "FETCH"
 	if tr == f.Transport {
 		prefix = "DIRECT"
 	}
+	filters.Tracef(ctx, f.name, prefix, "%s %s", req.Method, req.URL.Host)
 
 	resp, err := tr.RoundTrip(req)
 	if err != nil {
@@ -11,6 +11,7 @@ import (
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,8 +20,91 @@ import (
 	"github.com/phuslu/glog"
 
 	"../../helpers"
+	"../../metrics"
 )
 
+var (
+	gaeToggles  = metrics.NewCounter("goproxy_gae_appid_toggles_total", "Fetch servers moved to the bad list, by fetch server host.", "host")
+	gaeRequests = metrics.NewCounter("goproxy_gae_appid_requests_total", "Requests sent to fetch servers, by fetch server host and result.", "host", "result")
+	gaeBytes    = metrics.NewCounter("goproxy_gae_appid_bytes_total", "Bytes sent to and received from fetch servers, by fetch server host and direction.", "host", "direction")
+)
+
+const (
+	// StrategySticky sends the POST and non-static requests to the current
+	// fetch server, which changes only when it is over quota, and spreads the
+	// others uniformly.
+	StrategySticky string = "sticky"
+	// StrategyLatency prefers the fetch servers of the least round trip time.
+	StrategyLatency string = "latency"
+	// StrategyWeighted prefers the fetch servers of the highest success rate.
+	StrategyWeighted string = "weighted"
+
+	// ewmaWeight is the weight of the latest round trip in Latency and
+	// ErrorRate of ServerStats.
+	ewmaWeight float64 = 0.2
+	// minSuccessRate keeps the failing fetch servers getting a few requests,
+	// or they would never recover.
+	minSuccessRate float64 = 0.05
+	// defaultLatency is the latency of the fetch servers which have never
+	// succeeded, while none has.
+	defaultLatency time.Duration = 1 * time.Second
+)
+
+// quotaResetLocation is where the daily quotas of GAE reset at midnight.
+var quotaResetLocation = func() *time.Location {
+	if loc, err := time.LoadLocation("America/Los_Angeles"); err == nil {
+		return loc
+	}
+	return time.FixedZone("PST", -8*60*60)
+}()
+
+// lastQuotaReset returns the last daily quota reset of GAE before now.
+func lastQuotaReset(now time.Time) time.Time {
+	t := now.In(quotaResetLocation)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, quotaResetLocation)
+}
+
+// ServerStats is the quota accounting of a fetch server. OverQuota is set by
+// ToggleBadServer, and cleared once the daily quota has been reset since
+// LastOverQuota, or the server is restored. Latency and ErrorRate are moving
+// averages of the recent requests, which the strategies pick servers by.
+type ServerStats struct {
+	Requests      int64
+	Failures      int64
+	BytesSent     int64
+	BytesReceived int64
+	OverQuota     bool
+	LastOverQuota time.Time
+	Latency       time.Duration
+	ErrorRate     float64
+}
+
+// weight returns how much the fetch server of st deserves the requests under
+// strategy, the higher the better. latency stands for the latency of a fetch
+// server which has never succeeded.
+func (st *ServerStats) weight(strategy string, latency time.Duration) float64 {
+	success := 1 - st.ErrorRate
+	if success < minSuccessRate {
+		success = minSuccessRate
+	}
+
+	if strategy == StrategyLatency {
+		switch {
+		case st.Requests == 0:
+			// the untried servers are worth a try
+			latency = time.Millisecond
+		case st.Latency > 0:
+			latency = st.Latency
+		}
+		if latency < time.Millisecond {
+			latency = time.Millisecond
+		}
+		return success * float64(time.Second) / float64(latency)
+	}
+
+	return success
+}
+
 type Servers struct {
 	curURL    atomic.Value
 	muURL     sync.RWMutex
@@ -28,20 +112,45 @@ type Servers struct {
 	urls2     []url.URL
 	password  string
 	sslVerify bool
+	strategy  string
+
+	muStats sync.Mutex
+	stats   map[string]*ServerStats
 }
 
-func NewServers(urls []url.URL, password string, sslVerify bool) *Servers {
+// NewServers returns the Servers of urls, which picks them by strategy, one of
+// StrategySticky, StrategyLatency and StrategyWeighted.
+func NewServers(urls []url.URL, password string, sslVerify bool, strategy string) *Servers {
 	server := &Servers{
 		urls1:     urls,
 		urls2:     []url.URL{},
 		password:  password,
 		sslVerify: sslVerify,
+		strategy:  strategy,
+		stats:     make(map[string]*ServerStats),
+	}
+	for _, u := range urls {
+		server.stats[u.Host] = new(ServerStats)
 	}
 	server.curURL.Store(server.urls1[0])
 	return server
 }
 
+// ToggleBadServer moves fetchserver which is over quota to the bad list, or
+// swaps the lists if it was the last good one.
 func (s *Servers) ToggleBadServer(fetchserver url.URL) {
+	s.muStats.Lock()
+	st := s.stat(fetchserver.Host)
+	st.OverQuota = true
+	st.LastOverQuota = time.Now()
+	s.muStats.Unlock()
+
+	s.toggleBadServer(fetchserver)
+}
+
+func (s *Servers) toggleBadServer(fetchserver url.URL) {
+	gaeToggles.Inc(fetchserver.Host)
+
 	s.muURL.Lock()
 	defer s.muURL.Unlock()
 	urls := []url.URL{}
@@ -61,6 +170,160 @@ func (s *Servers) ToggleBadServer(fetchserver url.URL) {
 	s.curURL.Store(s.urls1[0])
 }
 
+// URLs returns copies of the good and bad fetch servers.
+func (s *Servers) URLs() (urls1, urls2 []url.URL) {
+	s.muURL.RLock()
+	defer s.muURL.RUnlock()
+	urls1 = append([]url.URL{}, s.urls1...)
+	urls2 = append([]url.URL{}, s.urls2...)
+	return
+}
+
+// ToggleServer moves the fetch server of host between the good and the bad
+// fetch servers.
+func (s *Servers) ToggleServer(host string) error {
+	if s.RestoreServer(host) {
+		return nil
+	}
+
+	s.muURL.Lock()
+	for _, u := range s.urls1 {
+		if u.Host == host {
+			s.muURL.Unlock()
+			s.toggleBadServer(u)
+			return nil
+		}
+	}
+	s.muURL.Unlock()
+	return fmt.Errorf("GAE: fetch server %#v not found", host)
+}
+
+// RestoreServer moves the fetch server of host from the bad fetch servers
+// back to the good ones, and reports whether it was a bad one.
+func (s *Servers) RestoreServer(host string) bool {
+	s.muStats.Lock()
+	if st, ok := s.stats[host]; ok {
+		st.OverQuota = false
+	}
+	s.muStats.Unlock()
+
+	s.muURL.Lock()
+	defer s.muURL.Unlock()
+	for i, u := range s.urls2 {
+		if u.Host == host {
+			s.urls2 = append(s.urls2[:i], s.urls2[i+1:]...)
+			s.urls1 = append(s.urls1, u)
+			return true
+		}
+	}
+	return false
+}
+
+// ResetQuota restores the over quota fetch servers whose daily quota has been
+// reset since, and returns their hosts.
+func (s *Servers) ResetQuota(now time.Time) []string {
+	reset := lastQuotaReset(now)
+
+	hosts := []string{}
+	s.muStats.Lock()
+	for host, st := range s.stats {
+		if st.OverQuota && st.LastOverQuota.Before(reset) {
+			hosts = append(hosts, host)
+		}
+	}
+	s.muStats.Unlock()
+
+	for _, host := range hosts {
+		s.RestoreServer(host)
+	}
+
+	return hosts
+}
+
+func (s *Servers) stat(host string) *ServerStats {
+	st, ok := s.stats[host]
+	if !ok {
+		st = new(ServerStats)
+		s.stats[host] = st
+	}
+	return st
+}
+
+// AddRequest accounts a request of bytesSent to the fetch server of host,
+// which took rtt to respond or fail.
+func (s *Servers) AddRequest(host string, bytesSent int64, rtt time.Duration, failed bool) {
+	result := "ok"
+
+	s.muStats.Lock()
+	st := s.stat(host)
+	st.Requests++
+	if failed {
+		st.Failures++
+		st.ErrorRate += ewmaWeight * (1 - st.ErrorRate)
+		result = "error"
+	} else {
+		st.ErrorRate -= ewmaWeight * st.ErrorRate
+		if st.Latency == 0 {
+			st.Latency = rtt
+		} else {
+			st.Latency += time.Duration(ewmaWeight * float64(rtt-st.Latency))
+		}
+	}
+	if bytesSent > 0 {
+		st.BytesSent += bytesSent
+	}
+	s.muStats.Unlock()
+
+	gaeRequests.Inc(host, result)
+	if bytesSent > 0 {
+		gaeBytes.Add(float64(bytesSent), host, "sent")
+	}
+}
+
+// addFailure accounts a failure of the fetch server of host which was found
+// in the response of an accounted request, like a urlfetch error.
+func (s *Servers) addFailure(host string) {
+	s.muStats.Lock()
+	s.stat(host).Failures++
+	s.muStats.Unlock()
+}
+
+func (s *Servers) addBytesReceived(host string, n int64) {
+	s.muStats.Lock()
+	s.stat(host).BytesReceived += n
+	s.muStats.Unlock()
+
+	gaeBytes.Add(float64(n), host, "received")
+}
+
+// Stats returns copies of the accounting of the fetch servers, keyed by their
+// hosts.
+func (s *Servers) Stats() map[string]ServerStats {
+	s.muStats.Lock()
+	defer s.muStats.Unlock()
+
+	m := make(map[string]ServerStats, len(s.stats))
+	for host, st := range s.stats {
+		m[host] = *st
+	}
+	return m
+}
+
+// statsBody accounts the bytes read from the response body of a fetch server.
+type statsBody struct {
+	io.ReadCloser
+	servers *Servers
+	host    string
+}
+
+func (b *statsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.servers.addBytesReceived(b.host, int64(n))
+	}
+	return n, err
+}
+
 func (s *Servers) EncodeRequest(req *http.Request, fetchserver url.URL, deadline time.Duration, brotli bool) (*http.Request, error) {
 	var err error
 	var b bytes.Buffer
@@ -189,6 +452,10 @@ func (s *Servers) PickFetchServer(req *http.Request, base int) url.URL {
 		perfer = true
 	}
 
+	if s.strategy == StrategyLatency || s.strategy == StrategyWeighted {
+		return s.pickByStats(perfer)
+	}
+
 	if perfer {
 		return s.curURL.Load().(url.URL)
 	} else {
@@ -197,3 +464,59 @@ func (s *Servers) PickFetchServer(req *http.Request, base int) url.URL {
 		return s.urls1[rand.Intn(len(s.urls1))]
 	}
 }
+
+// medianLatency returns the median of the latencies of the good fetch servers
+// which have succeeded, or defaultLatency if none has. The caller must hold
+// muURL and muStats.
+func (s *Servers) medianLatency() time.Duration {
+	var latencies []time.Duration
+	for _, u := range s.urls1 {
+		if st := s.stat(u.Host); st.Latency > 0 {
+			latencies = append(latencies, st.Latency)
+		}
+	}
+
+	if len(latencies) == 0 {
+		return defaultLatency
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	return latencies[len(latencies)/2]
+}
+
+// pickByStats returns the good fetch server of the highest weight if best,
+// or a random one in proportion to their weights.
+func (s *Servers) pickByStats(best bool) url.URL {
+	s.muURL.RLock()
+	defer s.muURL.RUnlock()
+
+	weights := make([]float64, len(s.urls1))
+	total := 0.0
+	j := 0
+
+	s.muStats.Lock()
+	latency := s.medianLatency()
+	for i, u := range s.urls1 {
+		weights[i] = s.stat(u.Host).weight(s.strategy, latency)
+		total += weights[i]
+		if weights[i] > weights[j] {
+			j = i
+		}
+	}
+	s.muStats.Unlock()
+
+	if best {
+		return s.urls1[j]
+	}
+
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return s.urls1[i]
+		}
+		r -= w
+	}
+
+	return s.urls1[len(s.urls1)-1]
+}
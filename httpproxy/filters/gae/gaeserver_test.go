@@ -0,0 +1,87 @@
+package gae
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServersQuota(t *testing.T) {
+	urls := []url.URL{
+		{Scheme: "https", Host: "a.appspot.com", Path: "/_gh/"},
+		{Scheme: "https", Host: "b.appspot.com", Path: "/_gh/"},
+	}
+	servers := NewServers(urls, "", false, StrategySticky)
+
+	servers.ToggleBadServer(urls[0])
+
+	if urls1, urls2 := servers.URLs(); len(urls1) != 1 || len(urls2) != 1 || urls2[0].Host != "a.appspot.com" {
+		t.Fatalf("ToggleBadServer should move a.appspot.com to the bad list, got %#v, %#v", urls1, urls2)
+	}
+
+	stats := servers.Stats()
+	if st := stats["a.appspot.com"]; !st.OverQuota || st.LastOverQuota.IsZero() {
+		t.Errorf("ToggleBadServer should mark a.appspot.com over quota, got %#v", st)
+	}
+	if _, ok := stats["b.appspot.com"]; !ok {
+		t.Errorf("Stats should have all fetch servers, got %#v", stats)
+	}
+
+	if hosts := servers.ResetQuota(time.Now()); len(hosts) != 0 {
+		t.Errorf("ResetQuota should not restore a.appspot.com before the daily reset, got %#v", hosts)
+	}
+
+	if hosts := servers.ResetQuota(time.Now().Add(24 * time.Hour)); !reflect.DeepEqual(hosts, []string{"a.appspot.com"}) {
+		t.Errorf("ResetQuota should restore a.appspot.com after the daily reset, got %#v", hosts)
+	}
+
+	if urls1, urls2 := servers.URLs(); len(urls1) != 2 || len(urls2) != 0 {
+		t.Errorf("ResetQuota should move a.appspot.com back to the good list, got %#v, %#v", urls1, urls2)
+	}
+	if st := servers.Stats()["a.appspot.com"]; st.OverQuota {
+		t.Errorf("ResetQuota should clear OverQuota of a.appspot.com, got %#v", st)
+	}
+}
+
+func TestServersStrategy(t *testing.T) {
+	urls := []url.URL{
+		{Scheme: "https", Host: "a.appspot.com", Path: "/_gh/"},
+		{Scheme: "https", Host: "b.appspot.com", Path: "/_gh/"},
+		{Scheme: "https", Host: "c.appspot.com", Path: "/_gh/"},
+	}
+
+	post, _ := http.NewRequest(http.MethodPost, "http://example.com/", nil)
+	static, _ := http.NewRequest(http.MethodGet, "http://example.com/a.js", nil)
+
+	for _, strategy := range []string{StrategyLatency, StrategyWeighted} {
+		servers := NewServers(urls, "", false, strategy)
+		for i := 0; i < 10; i++ {
+			servers.AddRequest("a.appspot.com", 0, 300*time.Millisecond, i%2 == 0)
+			servers.AddRequest("b.appspot.com", 0, 50*time.Millisecond, false)
+			servers.AddRequest("c.appspot.com", 0, 200*time.Millisecond, false)
+		}
+
+		if u := servers.PickFetchServer(post, 0); u.Host != "b.appspot.com" {
+			t.Errorf("%s: PickFetchServer should send POST to the best server b.appspot.com, got %#v", strategy, u.Host)
+		}
+
+		hosts := map[string]int{}
+		for i := 0; i < 1000; i++ {
+			hosts[servers.PickFetchServer(static, 0).Host]++
+		}
+		if len(hosts) != 3 || hosts["a.appspot.com"] >= hosts["b.appspot.com"] {
+			t.Errorf("%s: PickFetchServer should spread static requests by weight, got %#v", strategy, hosts)
+		}
+	}
+
+	servers := NewServers(urls[:2], "", false, StrategyLatency)
+	for i := 0; i < 10; i++ {
+		servers.AddRequest("a.appspot.com", 0, 0, true)
+		servers.AddRequest("b.appspot.com", 0, 200*time.Millisecond, false)
+	}
+	if u := servers.PickFetchServer(post, 0); u.Host != "b.appspot.com" {
+		t.Errorf("PickFetchServer should not prefer the always failing a.appspot.com, got %#v", u.Host)
+	}
+}
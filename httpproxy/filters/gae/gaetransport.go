@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -14,7 +15,13 @@ import (
 	quic "github.com/phuslu/quic-go"
 	"github.com/phuslu/quic-go/h2quic"
 
+	"../../filters"
 	"../../helpers"
+	"../../metrics"
+)
+
+var (
+	gaeRetries = metrics.NewCounter("goproxy_gae_retries_total", "GAETransport.RoundTrip retries, by fetch server host.", "host")
 )
 
 type Transport struct {
@@ -43,7 +50,7 @@ func (b *QuicBody) OnError(err error) {
 		ip, _, _ := net.SplitHostPort(b.RemoteAddr().String())
 		duration := 5 * time.Minute
 		glog.Warningf("GAE: QuicBody(%v) is timeout, add to blacklist for %v", ip, duration)
-		b.MultiDialer.IPBlackList.Set(ip, struct{}{}, time.Now().Add(duration))
+		b.MultiDialer.BlackListIP(ip, time.Now().Add(duration))
 	}
 }
 
@@ -61,7 +68,7 @@ func (t *Transport) roundTripQuic(req *http.Request) (*http.Response, error) {
 			ip, _, _ := net.SplitHostPort(ne.Addr.String())
 			duration := 5 * time.Minute
 			glog.Warningf("GAE: QuicBody(%v) is timeout, add to blacklist for %v", ip, duration)
-			t.MultiDialer.IPBlackList.Set(ip, struct{}{}, time.Now().Add(duration))
+			t.MultiDialer.BlackListIP(ip, time.Now().Add(duration))
 			helpers.CloseConnectionByRemoteHost(t1, ip)
 		} else {
 			t1.Close()
@@ -98,7 +105,7 @@ func (t *Transport) roundTripTLS(req *http.Request) (*http.Response, error) {
 			if t.MultiDialer != nil {
 				duration := 5 * time.Minute
 				glog.Warningf("GAE: %s is timeout, add to blacklist for %v", ip, duration)
-				t.MultiDialer.IPBlackList.Set(ip, struct{}{}, time.Now().Add(duration))
+				t.MultiDialer.BlackListIP(ip, time.Now().Add(duration))
 			}
 		}
 	}
@@ -163,7 +170,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 				if duration > 0 && t.MultiDialer != nil {
 					glog.Warningf("GAE: %s StatusCode is %d, not a gws/gvs ip, add to blacklist for %v", ip, resp.StatusCode, duration)
-					t.MultiDialer.IPBlackList.Set(ip, struct{}{}, time.Now().Add(duration))
+					t.MultiDialer.BlackListIP(ip, time.Now().Add(duration))
 					helpers.CloseConnectionByRemoteHost(t.RoundTripper, ip)
 				}
 			}
@@ -177,6 +184,7 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 type GAETransport struct {
+	Name        string
 	Transport   *Transport
 	MultiDialer *helpers.MultiDialer
 	Servers     *Servers
@@ -193,12 +201,17 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	retryDelay := t.RetryDelay
 	for i := 0; i < retryTimes; i++ {
 		server := t.Servers.PickFetchServer(req, i)
+		if i > 0 {
+			gaeRetries.Inc(server.Host)
+		}
 		req1, err := t.Servers.EncodeRequest(req, server, deadline, brotli)
 		if err != nil {
 			return nil, fmt.Errorf("GAE EncodeRequest: %s", err.Error())
 		}
 
+		start := time.Now()
 		resp, err := t.Transport.RoundTrip(req1)
+		t.Servers.AddRequest(server.Host, req1.ContentLength, time.Since(start), err != nil || resp.StatusCode != http.StatusOK)
 
 		if err != nil {
 			if i == retryTimes-1 {
@@ -215,6 +228,16 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 		if resp.StatusCode != http.StatusOK {
 			if i == retryTimes-1 {
+				if resp.StatusCode == http.StatusServiceUnavailable {
+					// an error only if the profile lets it fall through to the next filter
+					err := &filters.OverQuotaError{Filter: t.Name, Upstream: server.Host, Err: fmt.Errorf("fetch server returns %s", resp.Status)}
+					if filters.Fallthrough(req.Context(), err) {
+						glog.Warningf("GAE: %s over quota, no more appids to retry", server.Host)
+						t.Servers.ToggleBadServer(server)
+						resp.Body.Close()
+						return nil, err
+					}
+				}
 				return resp, nil
 			}
 
@@ -233,7 +256,7 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 						if ip, _, err := net.SplitHostPort(addr); err == nil {
 							duration := 8 * time.Hour
 							glog.Warningf("GAE: %s StatusCode is %d, not a gws/gvs ip, add to blacklist for %v", ip, resp.StatusCode, duration)
-							t.MultiDialer.IPBlackList.Set(ip, struct{}{}, time.Now().Add(duration))
+							t.MultiDialer.BlackListIP(ip, time.Now().Add(duration))
 							helpers.CloseConnectionByRemoteHost(t.Transport.RoundTripper, ip)
 						}
 					}
@@ -244,6 +267,9 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			}
 		}
 
+		// wrap the body only now, ReflectRemoteAddrFromResponse above needs the original one
+		resp.Body = &statsBody{resp.Body, t.Servers, server.Host}
+
 		resp1, err := t.Servers.DecodeResponse(resp)
 		if err != nil {
 			return nil, err
@@ -252,7 +278,7 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			resp1.Request = req
 		}
 		if i == retryTimes-1 {
-			return resp, err
+			return resp1, err
 		}
 
 		switch resp1.StatusCode {
@@ -263,6 +289,7 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 				return nil, err
 			}
 			resp1.Body.Close()
+			t.Servers.addFailure(server.Host)
 			switch {
 			case bytes.Contains(body, []byte("DEADLINE_EXCEEDED")):
 				//FIXME: deadline += 10 * time.Second
@@ -289,3 +316,77 @@ func (t *GAETransport) RoundTrip(req *http.Request) (*http.Response, error) {
 
 	return nil, fmt.Errorf("GAE: cannot reach here with %#v", req)
 }
+
+// ProbeServer sends a GET request of probeURL through fetchserver, and
+// returns an error if it is not served, like over quota.
+func (t *GAETransport) ProbeServer(ctx context.Context, fetchserver url.URL, probeURL string) error {
+	req, err := http.NewRequest(http.MethodGet, probeURL, nil)
+	if err != nil {
+		return err
+	}
+
+	req1, err := t.Servers.EncodeRequest(req, fetchserver, t.Deadline, false)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, err := t.Transport.RoundTrip(req1.WithContext(ctx))
+	t.Servers.AddRequest(fetchserver.Host, req1.ContentLength, time.Since(start), err != nil || resp.StatusCode != http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	resp.Body = &statsBody{resp.Body, t.Servers, fetchserver.Host}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetch server returns %s", resp.Status)
+	}
+
+	resp1, err := t.Servers.DecodeResponse(resp)
+	if err != nil {
+		return err
+	}
+
+	if resp1.StatusCode >= http.StatusInternalServerError {
+		t.Servers.addFailure(fetchserver.Host)
+		return fmt.Errorf("urlfetch %#v returns %s", probeURL, resp1.Status)
+	}
+
+	return nil
+}
+
+// CheckQuota restores the over quota fetch servers every interval, once the
+// daily quota has been reset since they went over quota, or once a request of
+// probeURL through them succeeds, until ctx is done. An empty probeURL
+// disables the probes.
+func (t *GAETransport) CheckQuota(ctx context.Context, interval time.Duration, probeURL string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, host := range t.Servers.ResetQuota(time.Now()) {
+			glog.Infof("GAE: %s daily quota has been reset, restore it", host)
+		}
+
+		if probeURL == "" {
+			continue
+		}
+
+		_, urls2 := t.Servers.URLs()
+		for _, u := range urls2 {
+			if err := t.ProbeServer(ctx, u, probeURL); err != nil {
+				glog.V(2).Infof("GAE: probe %s error: %v", u.Host, err)
+				continue
+			}
+			glog.Infof("GAE: probe %s OK, restore it", u.Host)
+			t.Servers.RestoreServer(u.Host)
+		}
+	}
+}
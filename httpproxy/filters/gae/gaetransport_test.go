@@ -0,0 +1,406 @@
+package gae
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"../../filters"
+)
+
+const (
+	// fakeOverQuota fails the fetch request with 503, like an AppID over quota.
+	fakeOverQuota string = "overquota"
+	// fakeDeadline fails the urlfetch with DEADLINE_EXCEEDED.
+	fakeDeadline string = "deadline"
+	// fakeClosed fails the urlfetch with "urlfetch: CLOSED".
+	fakeClosed string = "closed"
+	// fakeFound redirects the fetch request, like an IP which is not gws.
+	fakeFound string = "found"
+	// fakeSlow serves the response body in a few delayed chunks.
+	fakeSlow string = "slow"
+)
+
+// fakeFetchRequest is a request decoded by fakeFetchServer.
+type fakeFetchRequest struct {
+	Host    string
+	Options map[string]string
+	Request *http.Request
+	Body    []byte
+}
+
+// fakeFetchServer is an in-process GAE fetch server of the /_gh/ protocol. It
+// serves the decoded requests by Handler, or an echo of them if Handler is
+// nil, unless a fault has been queued for the fetch server host by Fail.
+type fakeFetchServer struct {
+	*httptest.Server
+	Password string
+	Handler  http.Handler
+
+	mu       sync.Mutex
+	faults   map[string][]string
+	requests []fakeFetchRequest
+}
+
+func newFakeFetchServer(password string) *fakeFetchServer {
+	s := &fakeFetchServer{
+		Password: password,
+		faults:   make(map[string][]string),
+	}
+	s.Server = httptest.NewTLSServer(s)
+	return s
+}
+
+// Host returns the fetch server host of name, which resolves to s.
+func (s *fakeFetchServer) Host(name string) string {
+	_, port, _ := net.SplitHostPort(s.Listener.Addr().String())
+	return net.JoinHostPort(name, port)
+}
+
+// Fail queues faults for the next requests to the fetch server name.
+func (s *fakeFetchServer) Fail(name string, faults ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[name] = append(s.faults[name], faults...)
+}
+
+// Requests returns the requests decoded so far.
+func (s *fakeFetchServer) Requests() []fakeFetchRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeFetchRequest{}, s.requests...)
+}
+
+func (s *fakeFetchServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/_gh/" {
+		http.NotFound(rw, r)
+		return
+	}
+
+	var hdrLen uint16
+	if err := binary.Read(r.Body, binary.BigEndian, &hdrLen); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hdrBuf := make([]byte, hdrLen)
+	if _, err := io.ReadFull(r.Body, hdrBuf); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hdr, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(hdrBuf)))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the header block has no empty line in the end
+	req, err := http.ReadRequest(bufio.NewReader(io.MultiReader(bytes.NewReader(hdr), strings.NewReader("\r\n"))))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options := make(map[string]string)
+	for _, option := range strings.Split(req.Header.Get("X-Urlfetch-Options"), ",") {
+		if option == "" {
+			continue
+		}
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) == 2 {
+			options[parts[0]] = parts[1]
+		} else {
+			options[parts[0]] = ""
+		}
+	}
+	req.Header.Del("X-Urlfetch-Options")
+
+	body, _ := ioutil.ReadAll(r.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	s.mu.Lock()
+	var fault string
+	if faults := s.faults[host]; len(faults) > 0 {
+		fault, s.faults[host] = faults[0], faults[1:]
+	}
+	s.requests = append(s.requests, fakeFetchRequest{r.Host, options, req, body})
+	s.mu.Unlock()
+
+	switch {
+	case fault == fakeOverQuota:
+		http.Error(rw, "Over Quota", http.StatusServiceUnavailable)
+	case fault == fakeFound:
+		rw.Header().Set("Location", "https://www.google.com/sorry/")
+		rw.WriteHeader(http.StatusFound)
+		io.WriteString(rw, "<html>302 Moved</html>")
+	case fault == fakeDeadline:
+		s.writeResponse(rw, http.StatusBadGateway, http.Header{}, []byte("DEADLINE_EXCEEDED"), false)
+	case fault == fakeClosed:
+		s.writeResponse(rw, http.StatusBadGateway, http.Header{}, []byte("urlfetch: CLOSED"), false)
+	case options["password"] != s.Password:
+		s.writeResponse(rw, http.StatusForbidden, http.Header{}, []byte("wrong password"), false)
+	default:
+		var h http.Handler = http.HandlerFunc(fakeEcho)
+		if s.Handler != nil {
+			h = s.Handler
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		s.writeResponse(rw, rec.Code, rec.Header(), rec.Body.Bytes(), fault == fakeSlow)
+	}
+}
+
+// writeResponse writes the deflated response header block of status and
+// header with its length, and then body.
+func (s *fakeFetchServer) writeResponse(rw http.ResponseWriter, status int, header http.Header, body []byte, slow bool) {
+	header.Set("Content-Length", fmt.Sprintf("%d", len(body)))
+
+	var b bytes.Buffer
+	w, _ := flate.NewWriter(&b, flate.BestCompression)
+	fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	header.Write(w)
+	io.WriteString(w, "\r\n")
+	w.Close()
+
+	rw.WriteHeader(http.StatusOK)
+	binary.Write(rw, binary.BigEndian, uint16(b.Len()))
+	rw.Write(b.Bytes())
+
+	if !slow {
+		rw.Write(body)
+		return
+	}
+
+	for len(body) > 0 {
+		n := len(body)/2 + 1
+		rw.Write(body[:n])
+		rw.(http.Flusher).Flush()
+		body = body[n:]
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func fakeEcho(rw http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	rw.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(rw, "%s %s %s", req.Method, req.URL.String(), body)
+}
+
+// newFakeGAEFilter returns a gae filter whose fetch servers are the names,
+// which all resolve to the fake fetch server s.
+func newFakeGAEFilter(t *testing.T, s *fakeFetchServer, names ...string) *Filter {
+	domains := make([]string, len(names))
+	for i, name := range names {
+		domains[i] = s.Host(name)
+	}
+
+	config := new(Config)
+	err := json.Unmarshal([]byte(`{
+		"Password": "`+s.Password+`",
+		"DisableHTTP2": true,
+		"SiteToAlias": {"*.gae.test": "google_test"},
+		"HostMap": {"google_test": ["127.0.0.1"]},
+		"TLSConfig": {"ClientSessionCacheSize": 16},
+		"Transport": {
+			"Dialer": {"DNSCacheExpiry": 600, "DNSCacheSize": 16, "Timeout": 5, "Level": 2},
+			"IdleConnTimeout": 10,
+			"MaxIdleConnsPerHost": 4,
+			"ResponseHeaderTimeout": 10,
+			"RetryDelay": 0.01,
+			"RetryTimes": 2
+		}
+	}`), config)
+	if err != nil {
+		t.Fatalf("json.Unmarshal error: %+v", err)
+	}
+	config.CustomDomains = domains
+
+	f, err := NewFilter(config)
+	if err != nil {
+		t.Fatalf("NewFilter error: %+v", err)
+	}
+
+	f1 := f.(*Filter)
+	// DEADLINE_EXCEEDED retries after Deadline
+	f1.GAETransport.Deadline = 10 * time.Millisecond
+
+	return f1
+}
+
+func fakeRoundTrip(f filters.RoundTripFilter, method, rawurl, body string) (*http.Response, string, error) {
+	req, _ := http.NewRequest(method, rawurl, strings.NewReader(body))
+	if body == "" {
+		req.Body = nil
+	}
+
+	_, resp, err := f.RoundTrip(context.Background(), req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp, string(data), err
+}
+
+func TestServersEncodeDecode(t *testing.T) {
+	s := newFakeFetchServer("secret")
+	defer s.Close()
+
+	u, _ := url.Parse(s.URL + "/_gh/")
+	servers := NewServers([]url.URL{*u}, "secret", true, StrategySticky)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/post?a=1", strings.NewReader("hello"))
+	req.Header.Set("X-Test", "1")
+
+	req1, err := servers.EncodeRequest(req, *u, 20*time.Second, true)
+	if err != nil {
+		t.Fatalf("EncodeRequest error: %+v", err)
+	}
+
+	resp, err := s.Client().Do(req1)
+	if err != nil {
+		t.Fatalf("fetch server error: %+v", err)
+	}
+	defer resp.Body.Close()
+
+	resp1, err := servers.DecodeResponse(resp)
+	if err != nil {
+		t.Fatalf("DecodeResponse error: %+v", err)
+	}
+	body, _ := ioutil.ReadAll(resp1.Body)
+
+	if resp1.StatusCode != http.StatusOK || string(body) != "POST http://example.com/post?a=1 hello" {
+		t.Errorf("DecodeResponse should return the echo, got %d %#v", resp1.StatusCode, string(body))
+	}
+
+	requests := s.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("fetch server should decode 1 request, got %#v", requests)
+	}
+
+	r := requests[0]
+	want := map[string]string{"deadline": "20", "brotli": "", "password": "secret", "sslverify": ""}
+	for key, value := range want {
+		if v, ok := r.Options[key]; !ok || v != value {
+			t.Errorf("X-Urlfetch-Options should have %s=%#v, got %#v", key, value, r.Options)
+		}
+	}
+	if r.Request.Header.Get("X-Test") != "1" {
+		t.Errorf("EncodeRequest should send the request headers, got %#v", r.Request.Header)
+	}
+}
+
+func TestFilterFetch(t *testing.T) {
+	s := newFakeFetchServer("123456")
+	defer s.Close()
+
+	f := newFakeGAEFilter(t, s, "a.gae.test")
+
+	resp, body, err := fakeRoundTrip(f, http.MethodGet, "http://example.com/hello", "")
+	if err != nil || resp.StatusCode != http.StatusOK || body != "GET http://example.com/hello " {
+		t.Fatalf("gae RoundTrip should return the echo, got %#v, %+v", body, err)
+	}
+
+	s.Fail("a.gae.test", fakeDeadline)
+	resp, body, err = fakeRoundTrip(f, http.MethodGet, "http://example.com/deadline", "")
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/plain" || body != "GET http://example.com/deadline " {
+		t.Errorf("gae RoundTrip should retry DEADLINE_EXCEEDED and decode the response, got %#v, %#v, %+v", resp, body, err)
+	}
+
+	if _, body, err = fakeRoundTrip(f, http.MethodPost, "http://example.com/post", "data"); err != nil || body != "POST http://example.com/post data" {
+		t.Errorf("gae RoundTrip should send the request body, got %#v, %+v", body, err)
+	}
+
+	s.Fail("a.gae.test", fakeClosed)
+	resp, body, err = fakeRoundTrip(f, http.MethodGet, "http://example.com/closed", "")
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/plain" || body != "GET http://example.com/closed " {
+		t.Errorf("gae RoundTrip should retry urlfetch: CLOSED and decode the response, got %#v, %#v, %+v", resp, body, err)
+	}
+
+	s.Fail("a.gae.test", fakeSlow)
+	s.Handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write(bytes.Repeat([]byte("x"), 4096))
+	})
+	if _, body, err = fakeRoundTrip(f, http.MethodGet, "http://example.com/slow", ""); err != nil || len(body) != 4096 {
+		t.Errorf("gae RoundTrip should read the slow body, got %d bytes, %+v", len(body), err)
+	}
+
+	st := f.GAETransport.Servers.Stats()[s.Host("a.gae.test")]
+	if st.Requests != 7 || st.Failures != 2 || st.BytesReceived < 4096 {
+		t.Errorf("Servers.Stats should account the requests, got %#v", st)
+	}
+}
+
+func TestFilterOverQuota(t *testing.T) {
+	s := newFakeFetchServer("123456")
+	defer s.Close()
+
+	f := newFakeGAEFilter(t, s, "a.gae.test")
+	host := s.Host("a.gae.test")
+
+	s.Fail("a.gae.test", fakeOverQuota)
+	if _, body, err := fakeRoundTrip(f, http.MethodGet, "http://example.com/", ""); err != nil || !strings.HasPrefix(body, "GET") {
+		t.Errorf("gae RoundTrip should retry over quota, got %#v, %+v", body, err)
+	}
+	if st := f.GAETransport.Servers.Stats()[host]; !st.OverQuota {
+		t.Errorf("gae RoundTrip should mark %s over quota, got %#v", host, st)
+	}
+
+	s.Fail("a.gae.test", fakeOverQuota, fakeOverQuota)
+	if resp, _, err := fakeRoundTrip(f, http.MethodGet, "http://example.com/", ""); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("gae RoundTrip should pass the last 503 through without a fallthrough policy, got %#v, %+v", resp, err)
+	}
+
+	ctx := filters.NewContext(context.Background(), nil, nil, nil, "")
+	filters.SetFallthrough(ctx, func(err error) bool { return filters.ErrorClass(err) == filters.ErrorClassQuota })
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	s.Fail("a.gae.test", fakeOverQuota, fakeOverQuota)
+	if _, _, err := f.RoundTrip(ctx, req.WithContext(ctx)); err == nil {
+		t.Errorf("gae RoundTrip should fail when all retries are over quota")
+	} else if e, ok := err.(*filters.OverQuotaError); !ok || e.Filter != "gae" {
+		t.Errorf("gae RoundTrip should return a OverQuotaError of gae, got %T(%v)", err, err)
+	}
+
+	u, _ := url.Parse("https://" + host + "/_gh/")
+	s.Fail("a.gae.test", fakeOverQuota)
+	if err := f.GAETransport.ProbeServer(context.Background(), *u, "http://example.com/"); err == nil {
+		t.Errorf("ProbeServer should fail over quota")
+	}
+	if err := f.GAETransport.ProbeServer(context.Background(), *u, "http://example.com/"); err != nil {
+		t.Errorf("ProbeServer should succeed, got %+v", err)
+	}
+}
+
+func TestFilterBlackList(t *testing.T) {
+	s := newFakeFetchServer("123456")
+	defer s.Close()
+
+	f := newFakeGAEFilter(t, s, "a.gae.test")
+
+	s.Fail("a.gae.test", fakeFound)
+	fakeRoundTrip(f, http.MethodGet, "http://example.com/", "")
+
+	if _, ok := f.GAETransport.MultiDialer.IPBlackList.GetQuiet("127.0.0.1"); !ok {
+		t.Errorf("gae RoundTrip should blacklist the ip which redirects the fetch request")
+	}
+}
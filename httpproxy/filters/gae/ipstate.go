@@ -0,0 +1,82 @@
+package gae
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+// ipStateFile returns the IP state file of filter instance name, which is
+// file for gae, and like "cache/gae-ipstate@hk.json" for gae@hk, lest the
+// instances overwrite the snapshots of each other.
+func ipStateFile(name, file string) string {
+	if _, instance := filters.SplitName(name); instance != "" {
+		ext := path.Ext(file)
+		return strings.TrimSuffix(file, ext) + "@" + instance + ext
+	}
+	return file
+}
+
+// loadIPStates restores the IP states snapshotted in filename into md, the
+// ones which have aged out meanwhile are dropped by md.SetIPStates.
+func loadIPStates(store storage.Store, filename string, md *helpers.MultiDialer) {
+	resp, err := store.Get(filename)
+	if err != nil {
+		if !storage.IsNotExist(resp, err) {
+			glog.Warningf("GAE: store.Get(%#v) error: %v", filename, err)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	var states map[string]helpers.IPState
+	if err = json.NewDecoder(resp.Body).Decode(&states); err != nil {
+		glog.Warningf("GAE: decode IP states %#v error: %v", filename, err)
+		return
+	}
+
+	md.SetIPStates(states)
+	glog.V(2).Infof("GAE: restored %d IP states from %#v", len(states), filename)
+}
+
+func saveIPStates(store storage.Store, filename string, md *helpers.MultiDialer) error {
+	data, err := json.MarshalIndent(md.IPStates(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Put(filename, http.Header{}, ioutil.NopCloser(bytes.NewReader(data)))
+	return err
+}
+
+// saveIPStatesEvery snapshots the IP states of md to filename every interval,
+// and once more when ctx is done.
+func saveIPStatesEvery(ctx context.Context, store storage.Store, filename string, md *helpers.MultiDialer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if err := saveIPStates(store, filename, md); err != nil {
+				glog.Warningf("GAE: save IP states to %#v error: %v", filename, err)
+			}
+			return
+		case <-ticker.C:
+			if err := saveIPStates(store, filename, md); err != nil {
+				glog.Warningf("GAE: save IP states to %#v error: %v", filename, err)
+			}
+		}
+	}
+}
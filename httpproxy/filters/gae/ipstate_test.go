@@ -0,0 +1,16 @@
+package gae
+
+import (
+	"testing"
+)
+
+func TestIPStateFile(t *testing.T) {
+	for name, want := range map[string]string{
+		"gae":    "cache/gae-ipstate.json",
+		"gae@hk": "cache/gae-ipstate@hk.json",
+	} {
+		if file := ipStateFile(name, "cache/gae-ipstate.json"); file != want {
+			t.Errorf("ipStateFile(%#v) should be %#v, got %#v", name, want, file)
+		}
+	}
+}
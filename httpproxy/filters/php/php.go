@@ -3,6 +3,7 @@ package php
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
@@ -15,7 +16,6 @@ import (
 	"../../filters"
 	"../../helpers"
 	"../../proxy"
-	"../../storage"
 )
 
 const (
@@ -49,19 +49,24 @@ type Config struct {
 }
 
 type Filter struct {
+	name string
 	Config
 	Transport *Transport
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
 		config := new(Config)
-		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		f.(*Filter).name = name
+		return f, nil
 	})
 }
 
@@ -117,7 +122,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	if config.Transport.Proxy.Enabled {
 		fixedURL, err := url.Parse(config.Transport.Proxy.URL)
 		if err != nil {
-			glog.Fatalf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
+			return nil, fmt.Errorf("url.Parse(%#v) error: %s", config.Transport.Proxy.URL, err)
 		}
 
 		switch fixedURL.Scheme {
@@ -128,7 +133,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		default:
 			dialer, err := proxy.FromURL(fixedURL, d, nil)
 			if err != nil {
-				glog.Fatalf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
+				return nil, fmt.Errorf("proxy.FromURL(%#v) error: %s", fixedURL.String(), err)
 			}
 
 			tr.Dial = dialer.Dial
@@ -145,6 +150,7 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	return &Filter{
+		name:   filterName,
 		Config: *config,
 		Transport: &Transport{
 			RoundTripper: tr,
@@ -154,10 +160,14 @@ func NewFilter(config *Config) (filters.Filter, error) {
 }
 
 func (p *Filter) FilterName() string {
-	return filterName
+	return p.name
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if filters.IsUpgrade(req) {
+		return ctx, nil, &filters.UpgradeUnsupportedError{Filter: f.name, Upgrade: req.Header.Get("Upgrade")}
+	}
+
 	resp, err := f.Transport.RoundTrip(req)
 	if err != nil {
 		return ctx, nil, err
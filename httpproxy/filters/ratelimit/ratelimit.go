@@ -0,0 +1,332 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+)
+
+const (
+	filterName string = "ratelimit"
+
+	limitersKey string = "ratelimit.limiters"
+)
+
+// Limit caps the bandwidth in bytes per second and the concurrency of a
+// client, or of all clients. Zero values are unlimited, zero bursts default
+// to one second of the rate.
+type Limit struct {
+	UploadRate     int64
+	UploadBurst    int64
+	DownloadRate   int64
+	DownloadBurst  int64
+	MaxConnections int
+	MaxRequests    int
+}
+
+type Config struct {
+	Global       Limit
+	PerIP        Limit
+	PerUser      Limit
+	ClientExpiry int
+}
+
+type Filter struct {
+	name string
+	Config
+	ClientExpiry time.Duration
+
+	mu        sync.Mutex
+	global    *limiter
+	clients   map[string]*limiter
+	lastSweep time.Time
+}
+
+// limiter holds the buckets and the active requests of a client. Active
+// connections are the client connections which are serving a request or a
+// tunnel, counted by their remote address.
+type limiter struct {
+	key      string
+	limit    *Limit
+	upload   *ratelimit.Bucket
+	download *ratelimit.Bucket
+	requests int
+	conns    map[string]int
+	lastSeen time.Time
+}
+
+func init() {
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		config := new(Config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
+		if err != nil {
+			return nil, err
+		}
+		f.(*Filter).name = name
+		return f, nil
+	})
+}
+
+// Validate reports the negative limits.
+func (c *Config) Validate() []error {
+	var errs []error
+	for i, limit := range []Limit{c.Global, c.PerIP, c.PerUser} {
+		if limit.UploadRate < 0 || limit.DownloadRate < 0 || limit.MaxConnections < 0 || limit.MaxRequests < 0 {
+			errs = append(errs, fmt.Errorf("RATELIMIT: %s has negative limits: %#v", []string{"Global", "PerIP", "PerUser"}[i], limit))
+		}
+	}
+	return errs
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	f := &Filter{
+		name:         filterName,
+		Config:       *config,
+		ClientExpiry: time.Duration(config.ClientExpiry) * time.Second,
+		clients:      make(map[string]*limiter),
+		lastSweep:    time.Now(),
+	}
+
+	if f.ClientExpiry <= 0 {
+		f.ClientExpiry = 10 * time.Minute
+	}
+
+	f.global = newLimiter("global", &f.Config.Global)
+
+	return f, nil
+}
+
+func newLimiter(key string, limit *Limit) *limiter {
+	l := &limiter{
+		key:   key,
+		limit: limit,
+		conns: make(map[string]int),
+	}
+
+	if limit.UploadRate > 0 {
+		l.upload = newBucket(limit.UploadRate, limit.UploadBurst)
+	}
+
+	if limit.DownloadRate > 0 {
+		l.download = newBucket(limit.DownloadRate, limit.DownloadBurst)
+	}
+
+	return l
+}
+
+func newBucket(rate, burst int64) *ratelimit.Bucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return ratelimit.NewBucketWithRate(float64(rate), burst)
+}
+
+func (f *Filter) FilterName() string {
+	return f.name
+}
+
+// Request admits req if no concurrency limit of its client is reached, and
+// rate limits its body. The limits are released when the Handler is done
+// with req, which covers the response body and hijacked tunnels.
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	limiters, err := f.acquire(req)
+	if err != nil {
+		glog.V(2).Infof("%s \"RATELIMIT %s %s %s\" %v", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+		filters.Tracef(ctx, f.name, "Reject", "%v", err)
+		rw := filters.GetResponseWriter(ctx)
+		rw.Header().Set("Retry-After", "1")
+		http.Error(rw, err.Error(), http.StatusTooManyRequests)
+		return ctx, filters.DummyRequest, nil
+	}
+
+	go func(done <-chan struct{}, remoteAddr string) {
+		<-done
+		f.release(limiters, remoteAddr)
+	}(ctx.Done(), req.RemoteAddr)
+
+	uploads, downloads := buckets(limiters)
+
+	if len(uploads) > 0 && req.Body != nil && req.Body != http.NoBody {
+		req.Body = helpers.ReaderCloser{Reader: limitReader(req.Body, uploads), Closer: req.Body}
+	}
+
+	if len(uploads) > 0 || len(downloads) > 0 {
+		filters.AddTunnelWrapper(ctx, func(conn net.Conn) net.Conn {
+			return &limitedConn{
+				Conn: conn,
+				r:    limitReader(conn, uploads),
+				w:    limitWriter(conn, downloads),
+			}
+		})
+	}
+
+	return context.WithValue(ctx, limitersKey, limiters), req, nil
+}
+
+// Response rate limits the response body with the download buckets of the
+// client.
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	limiters, ok := ctx.Value(limitersKey).([]*limiter)
+	if !ok || resp.Body == nil {
+		return ctx, resp, nil
+	}
+
+	if _, downloads := buckets(limiters); len(downloads) > 0 {
+		resp.Body = helpers.ReaderCloser{Reader: limitReader(resp.Body, downloads), Closer: resp.Body}
+	}
+
+	return ctx, resp, nil
+}
+
+// acquire counts req against the global, client IP and user limiters.
+func (f *Filter) acquire(req *http.Request) ([]*limiter, error) {
+	limiters := []*limiter{f.global}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil && isLimited(&f.Config.PerIP) {
+		limiters = append(limiters, f.client("ip:"+host, &f.Config.PerIP))
+	}
+
+	if user := getUsername(req); user != "" && isLimited(&f.Config.PerUser) {
+		limiters = append(limiters, f.client("user:"+user, &f.Config.PerUser))
+	}
+
+	for _, l := range limiters {
+		if max := l.limit.MaxRequests; max > 0 && l.requests >= max {
+			return nil, fmt.Errorf("%s reaches MaxRequests %d", l.key, max)
+		}
+		if max := l.limit.MaxConnections; max > 0 && l.conns[req.RemoteAddr] == 0 && len(l.conns) >= max {
+			return nil, fmt.Errorf("%s reaches MaxConnections %d", l.key, max)
+		}
+	}
+
+	for _, l := range limiters {
+		l.requests++
+		l.conns[req.RemoteAddr]++
+		l.lastSeen = now
+	}
+
+	if now.Sub(f.lastSweep) > f.ClientExpiry {
+		f.sweep(now)
+	}
+
+	return limiters, nil
+}
+
+func (f *Filter) release(limiters []*limiter, remoteAddr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	for _, l := range limiters {
+		l.requests--
+		if l.conns[remoteAddr]--; l.conns[remoteAddr] <= 0 {
+			delete(l.conns, remoteAddr)
+		}
+		l.lastSeen = now
+	}
+}
+
+// client returns the limiter of key, f.mu must be held.
+func (f *Filter) client(key string, limit *Limit) *limiter {
+	l, ok := f.clients[key]
+	if !ok {
+		l = newLimiter(key, limit)
+		f.clients[key] = l
+	}
+	return l
+}
+
+// sweep forgets the idle clients, f.mu must be held.
+func (f *Filter) sweep(now time.Time) {
+	for key, l := range f.clients {
+		if l.requests == 0 && now.Sub(l.lastSeen) > f.ClientExpiry {
+			delete(f.clients, key)
+		}
+	}
+	f.lastSweep = now
+}
+
+func isLimited(limit *Limit) bool {
+	return *limit != Limit{}
+}
+
+func getUsername(req *http.Request) string {
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return ""
+	}
+
+	userpass, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return ""
+	}
+
+	return strings.SplitN(string(userpass), ":", 2)[0]
+}
+
+func buckets(limiters []*limiter) (uploads, downloads []*ratelimit.Bucket) {
+	for _, l := range limiters {
+		if l.upload != nil {
+			uploads = append(uploads, l.upload)
+		}
+		if l.download != nil {
+			downloads = append(downloads, l.download)
+		}
+	}
+	return
+}
+
+func limitReader(r io.Reader, buckets []*ratelimit.Bucket) io.Reader {
+	for _, b := range buckets {
+		r = ratelimit.Reader(r, b)
+	}
+	return r
+}
+
+func limitWriter(w io.Writer, buckets []*ratelimit.Bucket) io.Writer {
+	for _, b := range buckets {
+		w = ratelimit.Writer(w, b)
+	}
+	return w
+}
+
+// limitedConn rate limits the bytes read from the client as upload, and the
+// bytes written to it as download.
+type limitedConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
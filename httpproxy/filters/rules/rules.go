@@ -0,0 +1,278 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+)
+
+const (
+	filterName string = "rules"
+
+	ActionBlock string = "block"
+)
+
+type Config struct {
+	Rules []struct {
+		Hosts   []string
+		Path    string
+		Methods []string
+		Headers map[string]string
+		Sources []string
+		Ports   []int
+		Action  string
+	}
+}
+
+// ReferredFilters returns the RoundTripFilters of the rule actions.
+func (c *Config) ReferredFilters() []string {
+	names := make([]string, 0)
+	for _, r := range c.Rules {
+		if r.Action != "" && r.Action != ActionBlock {
+			names = append(names, r.Action)
+		}
+	}
+	return names
+}
+
+// Rule matches requests on all of its non-empty conditions.
+type Rule struct {
+	Hosts   *helpers.HostMatcher
+	Path    *regexp.Regexp
+	Methods map[string]struct{}
+	Headers map[string]*regexp.Regexp
+	Sources []*net.IPNet
+	Ports   map[int]struct{}
+	Action  string
+	Filter  filters.RoundTripFilter
+}
+
+type Filter struct {
+	name string
+	Config
+	Rules []*Rule
+}
+
+func init() {
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
+		config := new(Config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
+		if err != nil {
+			return nil, err
+		}
+		f.(*Filter).name = name
+		return f, nil
+	})
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		name:   filterName,
+		Config: *config,
+		Rules:  make([]*Rule, 0, len(config.Rules)),
+	}
+
+	for i, c := range config.Rules {
+		r := &Rule{
+			Action: c.Action,
+		}
+
+		if len(c.Hosts) > 0 {
+			r.Hosts = helpers.NewHostMatcher(c.Hosts)
+		}
+
+		if c.Path != "" {
+			re, err := regexp.Compile(c.Path)
+			if err != nil {
+				return nil, fmt.Errorf("RULES: rule #%d regexp.Compile(%#v) error: %+v", i, c.Path, err)
+			}
+			r.Path = re
+		}
+
+		if len(c.Methods) > 0 {
+			r.Methods = make(map[string]struct{})
+			for _, method := range c.Methods {
+				r.Methods[strings.ToUpper(method)] = struct{}{}
+			}
+		}
+
+		if len(c.Headers) > 0 {
+			r.Headers = make(map[string]*regexp.Regexp)
+			for key, value := range c.Headers {
+				re, err := regexp.Compile(value)
+				if err != nil {
+					return nil, fmt.Errorf("RULES: rule #%d header %#v regexp.Compile(%#v) error: %+v", i, key, value, err)
+				}
+				r.Headers[http.CanonicalHeaderKey(key)] = re
+			}
+		}
+
+		for _, s := range c.Sources {
+			if !strings.Contains(s, "/") {
+				if strings.Contains(s, ":") {
+					s += "/128"
+				} else {
+					s += "/32"
+				}
+			}
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("RULES: rule #%d net.ParseCIDR(%#v) error: %+v", i, s, err)
+			}
+			r.Sources = append(r.Sources, ipnet)
+		}
+
+		if len(c.Ports) > 0 {
+			r.Ports = make(map[int]struct{})
+			for _, port := range c.Ports {
+				r.Ports[port] = struct{}{}
+			}
+		}
+
+		switch c.Action {
+		case "":
+			return nil, fmt.Errorf("RULES: rule #%d has no Action", i)
+		case ActionBlock:
+		default:
+			f1, err := filters.GetFilter(c.Action)
+			if err != nil {
+				return nil, fmt.Errorf("RULES: rule #%d filters.GetFilter(%#v) error: %v", i, c.Action, err)
+			}
+			f2, ok := f1.(filters.RoundTripFilter)
+			if !ok {
+				return nil, fmt.Errorf("RULES: rule #%d filters.GetFilter(%#v) return %T, not a RoundTripFilter", i, c.Action, f1)
+			}
+			r.Filter = f2
+		}
+
+		f.Rules = append(f.Rules, r)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return f.name
+}
+
+// Request records the RoundTripFilter of the first matching rule, or blocks
+// the request.
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	for i, r := range f.Rules {
+		if !r.Match(req) {
+			continue
+		}
+
+		if r.Action == ActionBlock {
+			glog.V(2).Infof("%s \"RULES #%d BLOCK %s %s %s\"", req.RemoteAddr, i, req.Method, req.URL.String(), req.Proto)
+			filters.Tracef(ctx, f.name, "Rule", "#%d block", i)
+			rw := filters.GetResponseWriter(ctx)
+			rw.WriteHeader(http.StatusForbidden)
+			io.WriteString(rw, "Blocked by rules\n")
+			return ctx, filters.DummyRequest, nil
+		}
+
+		glog.V(2).Infof("%s \"RULES #%d %s %s %s\" with %s", req.RemoteAddr, i, req.Method, req.URL.String(), req.Proto, r.Filter.FilterName())
+		filters.Tracef(ctx, f.name, "Rule", "#%d with %s", i, r.Filter.FilterName())
+		filters.SetRoundTripFilter(ctx, r.Filter)
+		break
+	}
+
+	return ctx, req, nil
+}
+
+// RoundTrip passes the request to the RoundTripFilter recorded by Request.
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if f1 := filters.GetRoundTripFilter(ctx); f1 != nil {
+		return f1.RoundTrip(ctx, req)
+	}
+
+	return ctx, nil, nil
+}
+
+func (r *Rule) Match(req *http.Request) bool {
+	if r.Methods != nil {
+		if _, ok := r.Methods[req.Method]; !ok {
+			return false
+		}
+	}
+
+	if r.Hosts != nil && !r.Hosts.Match(helpers.GetHostName(req)) {
+		return false
+	}
+
+	if r.Path != nil && !r.Path.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if r.Ports != nil {
+		if _, ok := r.Ports[getPort(req)]; !ok {
+			return false
+		}
+	}
+
+	for key, re := range r.Headers {
+		if !re.MatchString(req.Header.Get(key)) {
+			return false
+		}
+	}
+
+	if r.Sources != nil {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		matched := false
+		for _, ipnet := range r.Sources {
+			if ipnet.Contains(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getPort returns the destination port of req, CONNECT requests carry it in
+// Host, the others default to the port of the URL scheme.
+func getPort(req *http.Request) int {
+	if _, port, err := net.SplitHostPort(req.Host); err == nil {
+		if n, err := strconv.Atoi(port); err == nil {
+			return n
+		}
+	}
+
+	if port := req.URL.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err == nil {
+			return n
+		}
+	}
+
+	if req.URL.Scheme == "https" || req.Method == http.MethodConnect {
+		return 443
+	}
+
+	return 80
+}
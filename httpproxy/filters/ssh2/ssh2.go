@@ -13,7 +13,6 @@ import (
 
 	"../../filters"
 	"../../helpers"
-	"../../storage"
 )
 
 const (
@@ -35,20 +34,25 @@ type Config struct {
 }
 
 type Filter struct {
+	name string
 	Config
 	Transport      *http.Transport
 	SSHClientCache lrucache.Cache
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
 		config := new(Config)
-		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		f.(*Filter).name = name
+		return f, nil
 	})
 }
 
@@ -83,13 +87,14 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	return &Filter{
+		name:      filterName,
 		Config:    *config,
 		Transport: tr,
 	}, nil
 }
 
 func (p *Filter) FilterName() string {
-	return filterName
+	return p.name
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
@@ -120,13 +125,23 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		if err != nil {
 			return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
 		}
+		lconn = filters.WrapTunnel(ctx, lconn)
 		defer lconn.Close()
+		defer rconn.Close()
 
-		go helpers.IOCopy(rconn, lconn)
+		go func() {
+			helpers.IOCopy(rconn, lconn)
+			rconn.Close()
+		}()
 		helpers.IOCopy(lconn, rconn)
 
 		return ctx, filters.DummyResponse, nil
 	default:
+		if filters.IsUpgrade(req) {
+			glog.V(2).Infof("%s \"SSH2 UPGRADE %s %s %s\" %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, req.Header.Get("Upgrade"))
+			return filters.RelayUpgrade(ctx, req, f.Transport.Dial)
+		}
+
 		helpers.FixRequestURL(req)
 		resp, err := f.Transport.RoundTrip(req)
 
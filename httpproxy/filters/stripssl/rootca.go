@@ -50,10 +50,12 @@ func NewRootCA(name string, vaildFor time.Duration, certDir string, portable boo
 	certFile := name + ".crt"
 
 	var store storage.Store
-	if portable {
+	if os.Getenv(storage.StoreEnv) != "" {
+		store = storage.LookupStoreByFilterName(filterName)
+	} else if portable {
 		exe, err := os.Executable()
 		if err != nil {
-			glog.Fatalf("os.Executable() error: %+v", err)
+			return nil, fmt.Errorf("os.Executable() error: %+v", err)
 		}
 		store = &storage.FileStore{filepath.Dir(exe)}
 	} else {
@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"strconv"
@@ -16,7 +15,6 @@ import (
 
 	"../../filters"
 	"../../helpers"
-	"../../storage"
 )
 
 const (
@@ -38,6 +36,7 @@ type Config struct {
 }
 
 type Filter struct {
+	name string
 	Config
 	CA             *RootCA
 	CAExpiry       time.Duration
@@ -49,34 +48,41 @@ type Filter struct {
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
 		config := new(Config)
-		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		f.(*Filter).name = name
+		return f, nil
 	})
 }
 
 var (
 	defaultCA *RootCA
-	onceCA    sync.Once
+	muCA      sync.Mutex
 )
 
 func NewFilter(config *Config) (_ filters.Filter, err error) {
-	onceCA.Do(func() {
+	muCA.Lock()
+	if defaultCA == nil {
 		defaultCA, err = NewRootCA(config.RootCA.Name,
 			time.Duration(config.RootCA.Duration)*time.Second,
 			config.RootCA.Dirname,
 			config.RootCA.Portable)
-		if err != nil {
-			glog.Fatalf("NewRootCA(%#v) error: %v", config.RootCA.Name, err)
-		}
-	})
+	}
+	muCA.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("NewRootCA(%#v) error: %v", config.RootCA.Name, err)
+	}
 
 	f := &Filter{
+		name:           filterName,
 		Config:         *config,
 		TLSMaxVersion:  tls.VersionTLS12,
 		CA:             defaultCA,
@@ -103,7 +109,7 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 }
 
 func (f *Filter) FilterName() string {
-	return filterName
+	return f.name
 }
 
 func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
@@ -112,9 +118,17 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 	}
 
 	if f1 := filters.GetRoundTripFilter(ctx); f1 != nil {
-		if _, ok := f.Ignores[f1.FilterName()]; ok {
+		name := f1.FilterName()
+		if _, ok := f.Ignores[name]; ok {
+			filters.Tracef(ctx, f.name, "Ignores", "%s is ignored, not stripped", name)
 			return ctx, req, nil
 		}
+		if filterName, instance := filters.SplitName(name); instance != "" {
+			if _, ok := f.Ignores[filterName]; ok {
+				filters.Tracef(ctx, f.name, "Ignores", "%s is ignored, not stripped", name)
+				return ctx, req, nil
+			}
+		}
 	}
 
 	host, port, err := net.SplitHostPort(req.RequestURI)
@@ -123,6 +137,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 	}
 
 	if !f.Sites.Match(host) {
+		filters.Tracef(ctx, f.name, "Sites", "%s not matched, not stripped", host)
 		return ctx, req, nil
 	}
 
@@ -137,18 +152,21 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		return ctx, nil, fmt.Errorf("%#v does not implments Hijacker", rw)
 	}
 
-	conn, _, err := hijacker.Hijack()
-	if err != nil {
-		return ctx, nil, fmt.Errorf("http.ResponseWriter Hijack failed: %s", err)
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return ctx, nil, fmt.Errorf("%#v does not implments Flusher", rw)
 	}
 
-	_, err = io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	conn, _, err := hijacker.Hijack()
 	if err != nil {
-		conn.Close()
-		return ctx, nil, err
+		return ctx, nil, fmt.Errorf("http.ResponseWriter Hijack failed: %s", err)
 	}
 
 	glog.V(2).Infof("%s \"STRIP %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
+	filters.Tracef(ctx, f.name, "STRIP", "%s stripped=%v", req.Host, needStripSSL)
 
 	var c net.Conn = conn
 	if needStripSSL {
@@ -203,7 +221,10 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 	}
 
 	if ln1, ok := filters.GetListener(ctx).(helpers.Listener); ok {
-		ln1.Add(c)
+		if err := ln1.Add(c); err != nil {
+			c.Close()
+			return ctx, nil, err
+		}
 		return ctx, filters.DummyRequest, nil
 	}
 
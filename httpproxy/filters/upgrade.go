@@ -0,0 +1,128 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"../helpers"
+)
+
+// IsUpgrade reports whether req asks to switch to another protocol over its
+// connection, like WebSocket.
+func IsUpgrade(req *http.Request) bool {
+	if req.Method == http.MethodConnect || req.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RelayUpgrade sends the Upgrade request req over a connection from dial. If
+// the upstream switches protocols, it hijacks the client connection, relays
+// both directions until one of them is closed and returns DummyResponse,
+// otherwise it returns the upstream response.
+func RelayUpgrade(ctx context.Context, req *http.Request, dial func(network, addr string) (net.Conn, error)) (context.Context, *http.Response, error) {
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		switch req.URL.Scheme {
+		case "https", "wss":
+			addr = net.JoinHostPort(addr, "443")
+		default:
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+
+	rconn, err := dial("tcp", addr)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	if req.URL.Scheme == "https" || req.URL.Scheme == "wss" {
+		tlsConn := tls.Client(rconn, &tls.Config{
+			ServerName: req.URL.Hostname(),
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			rconn.Close()
+			return ctx, nil, err
+		}
+		rconn = tlsConn
+	}
+
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+
+	if err := req.Write(rconn); err != nil {
+		rconn.Close()
+		return ctx, nil, err
+	}
+
+	rbr := bufio.NewReader(rconn)
+	resp, err := http.ReadResponse(rbr, req)
+	if err != nil {
+		rconn.Close()
+		return ctx, nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = helpers.ReaderCloser{Reader: resp.Body, Closer: rconn}
+		return ctx, resp, nil
+	}
+
+	rw := GetResponseWriter(ctx)
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		rconn.Close()
+		return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw)
+	}
+
+	lconn, lbrw, err := hijacker.Hijack()
+	if err != nil {
+		rconn.Close()
+		return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
+	}
+	// the timeouts of the http.Server are meant for requests, not for the
+	// upgraded connection
+	lconn.SetDeadline(time.Time{})
+	lconn = WrapTunnel(ctx, lconn)
+	defer lconn.Close()
+	defer rconn.Close()
+
+	fmt.Fprintf(lconn, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(lconn)
+	if _, err := lconn.Write([]byte("\r\n")); err != nil {
+		return ctx, DummyResponse, nil
+	}
+
+	// either side may have sent data right after the handshake
+	if n := lbrw.Reader.Buffered(); n > 0 {
+		b, _ := lbrw.Reader.Peek(n)
+		rconn.Write(b)
+	}
+	if n := rbr.Buffered(); n > 0 {
+		b, _ := rbr.Peek(n)
+		lconn.Write(b)
+	}
+
+	go func() {
+		helpers.IOCopy(rconn, lconn)
+		rconn.Close()
+	}()
+	helpers.IOCopy(lconn, rconn)
+
+	return ctx, DummyResponse, nil
+}
@@ -12,7 +12,6 @@ import (
 
 	"../../filters"
 	"../../helpers"
-	"../../storage"
 )
 
 const (
@@ -29,19 +28,24 @@ type Config struct {
 }
 
 type Filter struct {
+	name    string
 	Servers []*Server
 	Sites   *helpers.HostMatcher
 }
 
 func init() {
-	filters.Register(filterName, func() (filters.Filter, error) {
-		filename := filterName + ".json"
+	filters.RegisterConfig(filterName, func() interface{} { return new(Config) })
+	filters.Register(filterName, func(name string) (filters.Filter, error) {
 		config := new(Config)
-		err := storage.LookupStoreByFilterName(filterName).UnmarshallJson(filename, config)
+		if err := filters.ReadConfig(name, config); err != nil {
+			return nil, err
+		}
+		f, err := NewFilter(config)
 		if err != nil {
-			glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+			return nil, err
 		}
-		return NewFilter(config)
+		f.(*Filter).name = name
+		return f, nil
 	})
 }
 
@@ -67,15 +71,20 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	return &Filter{
+		name:    filterName,
 		Servers: servers,
 	}, nil
 }
 
 func (p *Filter) FilterName() string {
-	return filterName
+	return p.name
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if filters.IsUpgrade(req) {
+		return ctx, nil, &filters.UpgradeUnsupportedError{Filter: f.name, Upgrade: req.Header.Get("Upgrade")}
+	}
+
 	i := 0
 	if helpers.IsStaticRequest(req) {
 		i = rand.Intn(len(f.Servers))
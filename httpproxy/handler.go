@@ -1,6 +1,7 @@
 package httpproxy
 
 import (
+	"bufio"
 	"context"
 	"fmt"
 	"io"
@@ -10,16 +11,28 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/phuslu/glog"
 
 	"./filters"
 	"./helpers"
+	"./metrics"
+)
+
+var (
+	requestsTotal   = metrics.NewCounter("goproxy_requests_total", "Requests served, by profile, RoundTrip filter and status code.", "profile", "filter", "code")
+	requestDuration = metrics.NewHistogram("goproxy_request_duration_seconds", "Request durations until the response body is copied, by profile and RoundTrip filter.", metrics.DefBuckets, "profile", "filter")
 )
 
 type Handler struct {
+	Profile          string
 	Listener         helpers.Listener
+	Transparent      bool
+	Fallthrough      *FallthroughPolicy
+	Trace            *TracePolicy
 	RequestFilters   []filters.RequestFilter
 	RoundTripFilters []filters.RoundTripFilter
 	ResponseFilters  []filters.ResponseFilter
@@ -32,9 +45,40 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	remoteAddr := req.RemoteAddr
 
 	// Prepare filter.Context
-	ctx := filters.NewContext(req.Context(), h, h.Listener, rw, h.Branding)
+	hrw := &hijackResponseWriter{ResponseWriter: rw}
+	ctx := filters.NewContext(req.Context(), h, h.Listener, hrw, h.Branding)
 	req = req.WithContext(ctx)
 
+	// Record metrics when the request is done, code is left empty if it
+	// should not be counted
+	var code string
+	defer func(start time.Time) {
+		if code == "" {
+			return
+		}
+		var name string
+		if f := filters.GetRoundTripFilter(ctx); f != nil {
+			name = f.FilterName()
+		}
+		requestsTotal.Inc(h.Profile, name, code)
+		requestDuration.Observe(time.Since(start).Seconds(), h.Profile, name)
+	}(time.Now())
+
+	// Return the filters.Tracef decisions to allowed debug clients, and log
+	// them when the request is done
+	var trace bool
+	if h.Trace != nil {
+		trace = h.Trace.Requested(req)
+		defer func() {
+			h.Trace.Log(ctx, req)
+		}()
+	}
+	writeTrace := func() {
+		if trace {
+			rw.Header().Set(TraceHeader, filters.FormatTrace(ctx))
+		}
+	}
+
 	// Enable transport http proxy
 	if req.Method != "CONNECT" && !req.URL.IsAbs() {
 		if req.URL.Scheme == "" {
@@ -61,15 +105,27 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				}
 			}
 		}
+
+		// Transparent requests are relative, fall back to the original destination
+		if h.Transparent && req.URL.Host == "" {
+			if req.Host != "" {
+				req.URL.Host = req.Host
+			} else if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+				req.URL.Host = addr.String()
+				req.Host = req.URL.Host
+			}
+		}
 	}
 
 	// Filter Request
 	for _, f := range h.RequestFilters {
 		ctx, req, err = f.Request(ctx, req)
 		if req == filters.DummyRequest {
+			code = "hijacked"
 			return
 		}
 		if err != nil {
+			code = "error"
 			if err != io.EOF {
 				glog.Errorf("%s Filter Request %T error: %+v", remoteAddr, f, err)
 			}
@@ -83,18 +139,67 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		defer req.Body.Close()
 	}
 
+	// Prepare the request to fall through the RoundTripFilters
+	var rewind func()
+	var match func(error) bool
+	if h.Fallthrough != nil && len(h.RoundTripFilters) > 1 {
+		match = func(err error) bool {
+			return h.Fallthrough.Match(req, err)
+		}
+		rewind, err = h.Fallthrough.Replayable(req)
+		if err != nil {
+			code = "error"
+			glog.Errorf("%s Fallthrough read request body error: %+v", remoteAddr, err)
+			return
+		}
+	}
+
 	// Filter Request -> Response
 	var resp *http.Response
-	for _, f := range h.RoundTripFilters {
+	var failed []string
+	for i, f := range h.RoundTripFilters {
+		if rewind != nil && i < len(h.RoundTripFilters)-1 {
+			filters.SetFallthrough(ctx, match)
+		} else {
+			filters.SetFallthrough(ctx, nil)
+		}
 		ctx, resp, err = f.RoundTrip(ctx, req)
 		if resp == filters.DummyResponse {
+			if filters.GetRoundTripFilter(ctx) == nil {
+				filters.SetRoundTripFilter(ctx, f)
+			}
+			code = "hijacked"
+			for _, f1 := range h.ResponseFilters {
+				if f2, ok := f1.(filters.HijackFilter); ok {
+					f2.Hijacked(ctx, req, hrw.BytesIn(), hrw.BytesOut())
+				}
+			}
 			return
 		}
+		// Upgrade requests go on to the next filter which can relay them
+		if ue, ok := err.(*filters.UpgradeUnsupportedError); ok && i < len(h.RoundTripFilters)-1 {
+			glog.V(2).Infof("%s Filter RoundTrip %T cannot upgrade to %#v, pass to %s", remoteAddr, f, ue.Upgrade, h.RoundTripFilters[i+1].FilterName())
+			filters.Tracef(ctx, "handler", "Upgrade", "%s unsupported", f.FilterName())
+			if rewind != nil {
+				rewind()
+			}
+			continue
+		}
+		// Errors which the profile lets fall through to the next filter
+		if err != nil && rewind != nil && i < len(h.RoundTripFilters)-1 && match(err) {
+			glog.Warningf("%s Filter RoundTrip %T error: %+v, fall through to %s", remoteAddr, f, err, h.RoundTripFilters[i+1].FilterName())
+			filters.Tracef(ctx, "handler", "Fallthrough", "%s error: %v", f.FilterName(), err)
+			failed = append(failed, f.FilterName())
+			rewind()
+			continue
+		}
 		// Unexcepted errors
 		if err != nil {
 			filters.SetRoundTripFilter(ctx, f)
+			code = strconv.Itoa(http.StatusBadGateway)
 			glog.Errorf("%s Filter RoundTrip %T error: %+v", remoteAddr, f, err)
-			http.Error(rw, h.FormatError(ctx, err), http.StatusBadGateway)
+			writeTrace()
+			h.WriteError(ctx, rw, req, http.StatusBadGateway, err)
 			return
 		}
 		// Update context for request
@@ -103,6 +208,10 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		if resp != nil {
 			resp.Request = req
 			filters.SetRoundTripFilter(ctx, f)
+			filters.Tracef(ctx, "handler", "RoundTrip", "served by %s", f.FilterName())
+			if len(failed) > 0 {
+				glog.Infof("%s \"%s %s %s\" served by %s after %s failed", remoteAddr, req.Method, req.URL.String(), req.Proto, f.FilterName(), strings.Join(failed, ", "))
+			}
 			break
 		}
 	}
@@ -114,8 +223,10 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 		ctx, resp, err = f.Response(ctx, resp)
 		if err != nil {
+			code = strconv.Itoa(http.StatusBadGateway)
 			glog.Errorln("%s Filter %T Response error: %+v", remoteAddr, f, err)
-			http.Error(rw, h.FormatError(ctx, err), http.StatusBadGateway)
+			writeTrace()
+			h.WriteError(ctx, rw, req, http.StatusBadGateway, err)
 			return
 		}
 		// Update context for request
@@ -123,8 +234,10 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	if resp == nil {
+		code = strconv.Itoa(http.StatusBadGateway)
 		glog.Errorln("%s Handler %#v Response empty response", remoteAddr, h)
-		http.Error(rw, h.FormatError(ctx, fmt.Errorf("empty response")), http.StatusBadGateway)
+		writeTrace()
+		h.WriteError(ctx, rw, req, http.StatusBadGateway, fmt.Errorf("empty response"))
 		return
 	}
 
@@ -136,7 +249,9 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			rw.Header().Add(key, value)
 		}
 	}
+	writeTrace()
 	rw.WriteHeader(resp.StatusCode)
+	code = strconv.Itoa(resp.StatusCode)
 	if resp.Body != nil {
 		defer resp.Body.Close()
 		n, err := helpers.IOCopy(rw, resp.Body)
@@ -156,18 +271,78 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (h Handler) FormatError(ctx context.Context, err error) string {
-	return fmt.Sprintf(`{
-    "type": "localproxy",
-    "host": "%s",
-    "software": "%s (go/%s %s/%s)",
-    "filter": "%T",
-    "error": "%s"
+// hijackResponseWriter counts the bytes of the hijacked connection for the
+// HijackFilters.
+type hijackResponseWriter struct {
+	http.ResponseWriter
+	conn *countConn
 }
-`, filters.GetListener(ctx).Addr().String(),
-		h.Branding, runtime.Version(), runtime.GOOS, runtime.GOARCH,
-		filters.GetRoundTripFilter(ctx),
-		err.Error())
+
+func (rw *hijackResponseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *hijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw.ResponseWriter)
+	}
+
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rw.conn = &countConn{Conn: conn}
+	return rw.conn, brw, nil
+}
+
+func (rw *hijackResponseWriter) BytesIn() int64 {
+	if rw.conn == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&rw.conn.in)
+}
+
+func (rw *hijackResponseWriter) BytesOut() int64 {
+	if rw.conn == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&rw.conn.out)
+}
+
+type countConn struct {
+	net.Conn
+	in  int64
+	out int64
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.in, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.out, int64(n))
+	return n, err
+}
+
+// WriteError writes the error page of err to rw, see filters.ErrorResponse.
+func (h Handler) WriteError(ctx context.Context, rw http.ResponseWriter, req *http.Request, code int, err error) {
+	resp := filters.ErrorResponse(ctx, req, code, err)
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		rw.Header()[key] = values
+	}
+	rw.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	rw.WriteHeader(resp.StatusCode)
+
+	io.Copy(rw, resp.Body)
 }
 
 func isClosedConnError(err error) bool {
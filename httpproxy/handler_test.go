@@ -0,0 +1,167 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"./filters"
+	"./helpers"
+)
+
+func TestHandlerErrorPage(t *testing.T) {
+	err := &filters.OverQuotaError{Filter: "gae", Upstream: "goproxy-demo.appspot.com", Err: errors.New("fetch server returns 503")}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	rw := testFallthrough(t, err, req)
+	if ct := rw.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("browsers should get a HTML error page, got %#v", ct)
+	}
+	for _, s := range []string{"GAE over quota", "goproxy-demo", `href="http://example.org/"`} {
+		if !strings.Contains(rw.Body.String(), s) {
+			t.Errorf("error page should contain %#v", s)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+
+	rw = testFallthrough(t, err, req)
+	var info filters.ErrorInfo
+	if err := json.Unmarshal(rw.Body.Bytes(), &info); err != nil {
+		t.Fatalf("API clients should get a JSON error, got %#v", rw.Body.String())
+	}
+	if rw.Code != http.StatusBadGateway || info.Category != filters.ErrorCategoryOverQuota || info.AppID != "goproxy-demo" {
+		t.Errorf("unexpected JSON error %d %#v", rw.Code, info)
+	}
+}
+
+func TestHandlerTrace(t *testing.T) {
+	p, err := NewTracePolicy("X-GoProxy-Debug", []string{"192.0.2.0/24"}, 0)
+	if err != nil {
+		t.Fatalf("NewTracePolicy error: %+v", err)
+	}
+
+	ln, err := helpers.ListenTCP("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("ListenTCP error: %+v", err)
+	}
+	defer ln.Close()
+
+	h := Handler{
+		Listener: ln,
+		Trace:    p,
+		RoundTripFilters: []filters.RoundTripFilter{
+			roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Header.Get("X-GoProxy-Debug") != "" {
+					t.Errorf("the debug header should not be sent upstream")
+				}
+				filters.Tracef(req.Context(), "test", "Site", "%s matched", req.Host)
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{},
+					Body:       http.NoBody,
+				}, nil
+			}),
+		},
+	}
+
+	// httptest.NewRequest comes from 192.0.2.1
+	req := httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+	req.Header.Set("X-GoProxy-Debug", "1")
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	want := "test Site: example.org matched; handler RoundTrip: served by test"
+	if got := rw.Header().Get(TraceHeader); got != want {
+		t.Errorf("%s should be %#v, got %#v", TraceHeader, want, got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.org/", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set("X-GoProxy-Debug", "1")
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	if got := rw.Header().Get(TraceHeader); got != "" {
+		t.Errorf("%s should not be sent to %s, got %#v", TraceHeader, req.RemoteAddr, got)
+	}
+}
+
+type relayFilter struct{}
+
+func (f relayFilter) FilterName() string {
+	return "relay"
+}
+
+func (f relayFilter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	return filters.RelayUpgrade(ctx, req, net.Dial)
+}
+
+func TestHandlerUpgrade(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !filters.IsUpgrade(req) {
+			http.Error(rw, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack error: %+v", err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		io.Copy(conn, brw)
+	}))
+	defer upstream.Close()
+
+	ln, err := helpers.ListenTCP("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("ListenTCP error: %+v", err)
+	}
+	defer ln.Close()
+
+	go http.Serve(ln, Handler{
+		Listener: ln,
+		RoundTripFilters: []filters.RoundTripFilter{
+			roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return nil, &filters.UpgradeUnsupportedError{Filter: "test", Upgrade: req.Header.Get("Upgrade")}
+			}),
+			relayFilter{},
+		},
+	})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial error: %+v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s/echo HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", upstream.URL, upstream.Listener.Addr())
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse error: %+v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("the upgrade should be relayed by the next filter, got %s", resp.Status)
+	}
+
+	io.WriteString(conn, "hello")
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "hello" {
+		t.Errorf("the upgraded connection should echo, got %#v, %+v", string(b), err)
+	}
+}
@@ -0,0 +1,115 @@
+package helpers
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	recordTypeHandshake       byte   = 0x16
+	handshakeTypeClientHello  byte   = 0x01
+	extensionServerName       uint16 = 0x0000
+	serverNameTypeHostName    byte   = 0x00
+	recordHeaderLen           int    = 5
+	maxClientHelloRecordLen   int    = 16384
+	clientHelloRandomLen      int    = 32
+	clientHelloFixedHeaderLen int    = 4 + 2 + clientHelloRandomLen
+)
+
+var (
+	ErrNotClientHello = errors.New("not a TLS ClientHello")
+	ErrNoServerName   = errors.New("TLS ClientHello has no server_name")
+)
+
+// PeekServerName returns the SNI of the TLS ClientHello at the head of br,
+// without consuming it. The ClientHello must fit in the first record.
+func PeekServerName(br *bufio.Reader) (string, error) {
+	hdr, err := br.Peek(recordHeaderLen)
+	if err != nil {
+		return "", err
+	}
+
+	if hdr[0] != recordTypeHandshake {
+		return "", ErrNotClientHello
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[3:5]))
+	if n > maxClientHelloRecordLen || recordHeaderLen+n > br.Size() {
+		return "", ErrNotClientHello
+	}
+
+	b, err := br.Peek(recordHeaderLen + n)
+	if err != nil {
+		return "", err
+	}
+
+	return parseServerName(b[recordHeaderLen:])
+}
+
+func parseServerName(b []byte) (string, error) {
+	if len(b) < clientHelloFixedHeaderLen || b[0] != handshakeTypeClientHello {
+		return "", ErrNotClientHello
+	}
+
+	b = b[clientHelloFixedHeaderLen:]
+
+	// session_id, cipher_suites, compression_methods
+	for _, size := range []int{1, 2, 1} {
+		if len(b) < size {
+			return "", ErrNotClientHello
+		}
+		n := int(b[0])
+		if size == 2 {
+			n = int(binary.BigEndian.Uint16(b))
+		}
+		if len(b) < size+n {
+			return "", ErrNotClientHello
+		}
+		b = b[size+n:]
+	}
+
+	if len(b) < 2 {
+		return "", ErrNoServerName
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < n {
+		return "", ErrNotClientHello
+	}
+	b = b[:n]
+
+	for len(b) >= 4 {
+		typ := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < n {
+			return "", ErrNotClientHello
+		}
+
+		if typ == extensionServerName {
+			ext := b[:n]
+			if len(ext) < 2 {
+				return "", ErrNotClientHello
+			}
+			ext = ext[2:]
+			for len(ext) >= 3 {
+				nameType := ext[0]
+				nameLen := int(binary.BigEndian.Uint16(ext[1:]))
+				ext = ext[3:]
+				if len(ext) < nameLen {
+					return "", ErrNotClientHello
+				}
+				if nameType == serverNameTypeHostName {
+					return string(ext[:nameLen]), nil
+				}
+				ext = ext[nameLen:]
+			}
+		}
+
+		b = b[n:]
+	}
+
+	return "", ErrNoServerName
+}
@@ -0,0 +1,47 @@
+package helpers
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func testPeekServerName(t *testing.T, serverName string) (string, error) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+
+	return PeekServerName(bufio.NewReader(c2))
+}
+
+func TestPeekServerName(t *testing.T) {
+	name, err := testPeekServerName(t, "www.example.org")
+	if err != nil {
+		t.Fatalf("PeekServerName error: %+v", err)
+	}
+	if name != "www.example.org" {
+		t.Errorf("PeekServerName should return \"www.example.org\", got %#v", name)
+	}
+}
+
+func TestPeekServerNameIP(t *testing.T) {
+	// crypto/tls sends no SNI for IP addresses
+	if _, err := testPeekServerName(t, "127.0.0.1"); err != ErrNoServerName {
+		t.Errorf("PeekServerName should return ErrNoServerName, got %+v", err)
+	}
+}
+
+func TestPeekServerNameHTTP(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go c1.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	if _, err := PeekServerName(bufio.NewReader(c2)); err != ErrNotClientHello {
+		t.Errorf("PeekServerName should return ErrNotClientHello, got %+v", err)
+	}
+}
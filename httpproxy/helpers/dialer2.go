@@ -9,11 +9,19 @@ import (
 	"net"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/phuslu/glog"
 	quic "github.com/phuslu/quic-go"
+
+	"../metrics"
+)
+
+var (
+	ipBlackListInsertions = metrics.NewCounter("goproxy_ip_blacklist_insertions_total", "IPs added to the MultiDialer IPBlackList.")
+	handshakeSeconds      = metrics.NewHistogram("goproxy_dialer_handshake_seconds", "MultiDialer TLS and QUIC handshake durations.", metrics.DefBuckets, "proto", "result")
 )
 
 type MultiDialer struct {
@@ -35,6 +43,31 @@ type MultiDialer struct {
 	GoodConnExpiry    time.Duration
 	ErrorConnExpiry   time.Duration
 	Level             int
+
+	hostsMu sync.Mutex
+	hosts   map[string]struct{}
+
+	hostMapMu sync.RWMutex
+
+	ipStatesMu sync.Mutex
+	ipStates   map[string]*IPState
+}
+
+// BlackListIP adds ip to IPBlackList until expire, a zero expire never
+// expires.
+func (d *MultiDialer) BlackListIP(ip string, expire time.Time) {
+	d.blackListIP(ip, expire)
+	ipBlackListInsertions.Inc()
+}
+
+func (d *MultiDialer) blackListIP(ip string, expire time.Time) {
+	d.IPBlackList.Set(ip, struct{}{}, expire)
+
+	d.ipStatesMu.Lock()
+	s := d.ipState(ip)
+	s.BlackListed = true
+	s.BlackListExpiry = expire
+	d.ipStatesMu.Unlock()
 }
 
 func (d *MultiDialer) ClearCache() {
@@ -43,8 +76,128 @@ func (d *MultiDialer) ClearCache() {
 	d.TLSConnError.Clear()
 }
 
+// Hosts returns all hosts which LookupAlias has resolved so far, including
+// the blacklisted ones.
+func (d *MultiDialer) Hosts() []string {
+	d.hostsMu.Lock()
+	defer d.hostsMu.Unlock()
+
+	hosts := make([]string, 0, len(d.hosts))
+	for host := range d.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	return hosts
+}
+
+type MultiDialerStatus struct {
+	TLSConnDuration map[string]string
+	TLSConnError    map[string]string
+	IPBlackList     []string
+}
+
+// Status returns the TLSConnDuration, TLSConnError and IPBlackList entries of
+// the hosts returned by Hosts.
+func (d *MultiDialer) Status() MultiDialerStatus {
+	status := MultiDialerStatus{
+		TLSConnDuration: make(map[string]string),
+		TLSConnError:    make(map[string]string),
+		IPBlackList:     []string{},
+	}
+
+	for _, host := range d.Hosts() {
+		if v, ok := d.TLSConnDuration.GetNotStale(host); ok {
+			status.TLSConnDuration[host] = fmt.Sprintf("%v", v)
+		}
+		if v, ok := d.TLSConnError.GetNotStale(host); ok {
+			status.TLSConnError[host] = fmt.Sprintf("%v", v)
+		}
+		if _, ok := d.IPBlackList.GetQuiet(host); ok {
+			status.IPBlackList = append(status.IPBlackList, host)
+		}
+	}
+
+	return status
+}
+
+// AddHosts appends the new ones of hosts to alias in HostMap, while the
+// dialer is in use, and returns them.
+func (d *MultiDialer) AddHosts(alias string, hosts []string) []string {
+	d.hostMapMu.Lock()
+	defer d.hostMapMu.Unlock()
+
+	names := d.HostMap[alias]
+
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		seen[name] = struct{}{}
+	}
+
+	names1 := make([]string, len(names), len(names)+len(hosts))
+	copy(names1, names)
+	for _, host := range hosts {
+		if _, ok := seen[host]; ok {
+			continue
+		}
+		seen[host] = struct{}{}
+		names1 = append(names1, host)
+	}
+
+	if d.HostMap == nil {
+		d.HostMap = make(map[string][]string)
+	}
+	d.HostMap[alias] = names1
+
+	return names1[len(names):]
+}
+
+// RemoveHosts removes hosts from alias in HostMap, while the dialer is in use,
+// and returns how many are removed.
+func (d *MultiDialer) RemoveHosts(alias string, hosts []string) int {
+	d.hostMapMu.Lock()
+	defer d.hostMapMu.Unlock()
+
+	names := d.HostMap[alias]
+
+	removed := make(map[string]struct{}, len(hosts))
+	for _, host := range hosts {
+		removed[host] = struct{}{}
+	}
+
+	names1 := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := removed[name]; !ok {
+			names1 = append(names1, name)
+		}
+	}
+
+	if len(names1) < len(names) {
+		d.HostMap[alias] = names1
+	}
+
+	return len(names) - len(names1)
+}
+
+// VerifyGoogleCert checks the issuer of a Google certificate chain, which must
+// be one of the Google CAs, and pass GoogleValidator if it is set.
+func (d *MultiDialer) VerifyGoogleCert(certs []*x509.Certificate) error {
+	if len(certs) <= 1 {
+		return fmt.Errorf("Wrong certificate: PeerCertificates=%#v", certs)
+	}
+
+	cert := certs[1]
+	if (d.GoogleValidator != nil && !d.GoogleValidator(cert)) || !strings.HasPrefix(cert.Subject.CommonName, "Google ") {
+		return fmt.Errorf("Wrong certificate: Issuer=%v, SubjectKeyId=%#v", cert.Subject, cert.SubjectKeyId)
+	}
+
+	return nil
+}
+
 func (d *MultiDialer) LookupAlias(alias string) (hosts []string, err error) {
+	d.hostMapMu.RLock()
 	names, ok := d.HostMap[alias]
+	d.hostMapMu.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("alias %#v not exists", alias)
 	}
@@ -66,6 +219,15 @@ func (d *MultiDialer) LookupAlias(alias string) (hosts []string, err error) {
 		}
 	}
 
+	d.hostsMu.Lock()
+	if d.hosts == nil {
+		d.hosts = make(map[string]struct{})
+	}
+	for host := range seen {
+		d.hosts[host] = struct{}{}
+	}
+	d.hostsMu.Unlock()
+
 	if len(seen) == 0 {
 		return nil, err
 	}
@@ -142,16 +304,12 @@ func (d *MultiDialer) DialTLS2(network, address string, cfg *tls.Config) (net.Co
 							if len(certs) <= 1 {
 								return nil, fmt.Errorf("Wrong certificate of %s: PeerCertificates=%#v", conn.RemoteAddr(), certs)
 							}
-							cert := certs[1]
-							glog.V(3).Infof("MULTIDIALER DialTLS(%#v, %#v) verify cert=%v", network, address, cert.Subject)
-							switch {
-							case d.GoogleValidator != nil && !d.GoogleValidator(cert):
-								fallthrough
-							case !strings.HasPrefix(cert.Subject.CommonName, "Google "):
-								err := fmt.Errorf("Wrong certificate of %s: Issuer=%v, SubjectKeyId=%#v", conn.RemoteAddr(), cert.Subject, cert.SubjectKeyId)
+							glog.V(3).Infof("MULTIDIALER DialTLS(%#v, %#v) verify cert=%v", network, address, certs[1].Subject)
+							if err := d.VerifyGoogleCert(certs); err != nil {
+								err = fmt.Errorf("%v of %s", err, conn.RemoteAddr())
 								glog.Warningf("MultiDailer: %v", err)
 								if ip, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
-									d.IPBlackList.Set(ip, struct{}{}, time.Time{})
+									d.BlackListIP(ip, time.Time{})
 								}
 								conn.Close()
 								return nil, err
@@ -199,8 +357,7 @@ func (d *MultiDialer) dialMultiTLS(network string, hosts []string, port string,
 
 			conn, err := net.DialTCPContext(ctx, network, nil, raddr)
 			if err != nil {
-				d.TLSConnDuration.Del(host)
-				d.TLSConnError.Set(host, err, time.Now().Add(d.ErrorConnExpiry))
+				d.connError(host, err, time.Now())
 				lane <- connWithError{nil, err}
 				return
 			}
@@ -226,10 +383,11 @@ func (d *MultiDialer) dialMultiTLS(network string, hosts []string, port string,
 
 			end := time.Now()
 			if err != nil {
-				d.TLSConnDuration.Del(host)
-				d.TLSConnError.Set(host, err, end.Add(d.ErrorConnExpiry))
+				d.connError(host, err, end)
+				handshakeSeconds.Observe(end.Sub(start).Seconds(), "tls", "error")
 			} else {
-				d.TLSConnDuration.Set(host, end.Sub(start), end.Add(d.GoodConnExpiry))
+				d.connGood(host, end.Sub(start), end)
+				handshakeSeconds.Observe(end.Sub(start).Seconds(), "tls", "ok")
 			}
 
 			lane <- connWithError{tlsConn, err}
@@ -252,7 +410,7 @@ func (d *MultiDialer) dialMultiTLS(network string, hosts []string, port string,
 			return r.c, nil
 		}
 	}
-	return nil, r.e
+	return nil, dialError(network, r.e)
 }
 
 func (d *MultiDialer) DialQuic(address string, tlsConfig *tls.Config, cfg *quic.Config) (quic.Session, error) {
@@ -342,10 +500,11 @@ func (d *MultiDialer) dialMultiQuic(hosts []string, port string, tlsConfig *tls.
 			end := time.Now()
 
 			if err != nil {
-				d.TLSConnDuration.Del(host)
-				d.TLSConnError.Set(host, err, end.Add(d.ErrorConnExpiry))
+				d.connError(host, err, end)
+				handshakeSeconds.Observe(end.Sub(start).Seconds(), "quic", "error")
 			} else {
-				d.TLSConnDuration.Set(host, end.Sub(start), end.Add(d.GoodConnExpiry))
+				d.connGood(host, end.Sub(start), end)
+				handshakeSeconds.Observe(end.Sub(start).Seconds(), "quic", "ok")
 			}
 
 			lane <- sessWithError{sess, err}
@@ -368,7 +527,19 @@ func (d *MultiDialer) dialMultiQuic(hosts []string, port string, tlsConfig *tls.
 			return r.s, nil
 		}
 	}
-	return nil, r.e
+	return nil, dialError("udp", r.e)
+}
+
+// dialError marks the handshake errors of the last host as a dial failure,
+// so that the callers could tell them from the errors of established conns.
+func dialError(network string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*net.OpError); ok {
+		return err
+	}
+	return &net.OpError{Op: "dial", Net: network, Err: err}
 }
 
 func (d *MultiDialer) pickupTLSHosts(hosts []string, n int) []string {
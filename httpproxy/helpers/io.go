@@ -4,6 +4,8 @@ import (
 	"io"
 	"sync"
 	// "github.com/cloudflare/golibs/bytepool"
+
+	"../metrics"
 )
 
 const (
@@ -16,11 +18,14 @@ var (
 			return make([]byte, BUFSZ)
 		},
 	}
+
+	ioCopyBytes = metrics.NewCounter("goproxy_iocopy_bytes_total", "Bytes copied by IOCopy.")
 )
 
 func IOCopy(dst io.Writer, src io.Reader) (written int64, err error) {
 	buf := bufpool.Get().([]byte)
 	written, err = io.CopyBuffer(dst, src, buf)
 	bufpool.Put(buf)
+	ioCopyBytes.Add(float64(written))
 	return written, err
 }
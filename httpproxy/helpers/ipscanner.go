@@ -0,0 +1,304 @@
+package helpers
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../metrics"
+)
+
+var (
+	ipScannerProbes = metrics.NewCounter("goproxy_ipscanner_probes_total", "IPScanner probes, by result.", "result")
+)
+
+// IPRange is an inclusive range of IPs, like a line
+// "64.233.160.0-64.233.191.255" of iprange.conf.
+type IPRange struct {
+	First net.IP
+	Last  net.IP
+}
+
+// ParseIPRanges reads the ranges in r, one in a line as "first-last", a CIDR
+// or a single IP. The empty lines and the lines starting with "#" are skipped.
+func ParseIPRanges(r io.Reader) ([]IPRange, error) {
+	var ranges []IPRange
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var ipr IPRange
+		switch {
+		case strings.Contains(line, "-"):
+			parts := strings.SplitN(line, "-", 2)
+			ipr.First = net.ParseIP(strings.TrimSpace(parts[0]))
+			ipr.Last = net.ParseIP(strings.TrimSpace(parts[1]))
+		case strings.Contains(line, "/"):
+			_, ipnet, err := net.ParseCIDR(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			ipr.First = ipnet.IP
+			ipr.Last = make(net.IP, len(ipnet.IP))
+			for i := range ipnet.IP {
+				ipr.Last[i] = ipnet.IP[i] | ^ipnet.Mask[i]
+			}
+		default:
+			ipr.First = net.ParseIP(line)
+			ipr.Last = ipr.First
+		}
+
+		if ipr.First == nil || ipr.Last == nil || ipCmp(ipr.First, ipr.Last) > 0 {
+			return nil, fmt.Errorf("line %d: invalid ip range %#v", n, line)
+		}
+
+		ranges = append(ranges, ipr)
+	}
+
+	return ranges, scanner.Err()
+}
+
+func ipInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return new(big.Int).SetBytes(ip)
+}
+
+func ipCmp(a, b net.IP) int {
+	return ipInt(a).Cmp(ipInt(b))
+}
+
+// Random returns a random IP in the range.
+func (r IPRange) Random(rnd *rand.Rand) net.IP {
+	first := ipInt(r.First)
+	n := new(big.Int).Sub(ipInt(r.Last), first)
+	n.Add(n, big.NewInt(1))
+
+	b := new(big.Int).Add(first, new(big.Int).Rand(rnd, n)).Bytes()
+
+	size := net.IPv6len
+	if r.First.To4() != nil {
+		size = net.IPv4len
+	}
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+
+	return ip
+}
+
+// IPScanner keeps enough good IPs in the aliases of a MultiDialer. Whenever
+// the IPs of an alias which are not blacklisted fall below MinGoodIPs, it
+// probes random IPs in Ranges for the ones which complete a TLS handshake
+// with a Google certificate, and adds them to the alias. The probes are sent
+// by Concurrency workers at no more than Rate per second, so that the scans
+// do not look like an attack to the firewalls. The added IPs are removed again
+// once they are blacklisted or fail, and no more than MinGoodIPs+MaxNewIPs of
+// them are kept in an alias.
+type IPScanner struct {
+	MultiDialer *MultiDialer
+	Aliases     []string
+	Ranges      []IPRange
+	Port        string
+	TLSConfig   *tls.Config
+	MinGoodIPs  int
+	MaxNewIPs   int
+	MaxProbes   int
+	Concurrency int
+	Rate        int
+	Timeout     time.Duration
+	Interval    time.Duration
+
+	added map[string][]string
+}
+
+// Run checks the aliases every Interval until ctx is done.
+func (s *IPScanner) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, alias := range s.Aliases {
+			s.prune(alias)
+
+			hosts, _ := s.MultiDialer.LookupAlias(alias)
+			if len(hosts) >= s.MinGoodIPs {
+				continue
+			}
+
+			ips := s.Scan(ctx, s.MaxNewIPs)
+			added := s.MultiDialer.AddHosts(alias, ips)
+			if s.added == nil {
+				s.added = make(map[string][]string)
+			}
+			s.added[alias] = append(s.added[alias], added...)
+			glog.Infof("IPScanner: alias %#v has %d good ips, added %d new ips", alias, len(hosts), len(added))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune removes the IPs which have been added to alias, and which have been
+// blacklisted or failed since, and then the oldest ones over the limit.
+func (s *IPScanner) prune(alias string) {
+	added := s.added[alias]
+	if len(added) == 0 {
+		return
+	}
+
+	var bad, kept []string
+	for _, ip := range added {
+		_, blacklisted := s.MultiDialer.IPBlackList.GetQuiet(ip)
+		_, failed := s.MultiDialer.TLSConnError.GetNotStale(ip)
+		if blacklisted || failed {
+			bad = append(bad, ip)
+		} else {
+			kept = append(kept, ip)
+		}
+	}
+
+	if max := s.MinGoodIPs + s.MaxNewIPs; len(kept) > max {
+		bad = append(bad, kept[:len(kept)-max]...)
+		kept = kept[len(kept)-max:]
+	}
+
+	if len(bad) > 0 {
+		n := s.MultiDialer.RemoveHosts(alias, bad)
+		glog.Infof("IPScanner: alias %#v removed %d bad or old scanned ips", alias, n)
+	}
+
+	s.added[alias] = kept
+}
+
+// Scan probes up to MaxProbes random IPs, and returns up to n good ones.
+func (s *IPScanner) Scan(ctx context.Context, n int) []string {
+	if len(s.Ranges) == 0 || n <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	candidates := make(chan string)
+	go func() {
+		defer close(candidates)
+
+		var tick <-chan time.Time
+		if s.Rate > 0 {
+			ticker := time.NewTicker(time.Second / time.Duration(s.Rate))
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		seen := make(map[string]struct{})
+		for i := 0; i < s.MaxProbes; i++ {
+			ip := s.Ranges[rnd.Intn(len(s.Ranges))].Random(rnd).String()
+			if _, ok := seen[ip]; ok {
+				continue
+			}
+			seen[ip] = struct{}{}
+			if _, ok := s.MultiDialer.IPBlackList.GetQuiet(ip); ok {
+				continue
+			}
+
+			if tick != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-tick:
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case candidates <- ip:
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	good := make([]string, 0, n)
+
+	concurrency := s.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ip := range candidates {
+				if err := s.probe(ctx, ip); err != nil {
+					glog.V(3).Infof("IPScanner: probe %s error: %v", ip, err)
+					ipScannerProbes.Inc("error")
+					continue
+				}
+				ipScannerProbes.Inc("ok")
+
+				mu.Lock()
+				if len(good) < n {
+					good = append(good, ip)
+				}
+				if len(good) >= n {
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return good
+}
+
+func (s *IPScanner) probe(ctx context.Context, ip string) error {
+	dialer := &net.Dialer{Timeout: s.Timeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, s.Port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	start := time.Now()
+	tlsConn := tls.Client(conn, s.TLSConfig)
+	if err = tlsConn.Handshake(); err != nil {
+		return err
+	}
+	end := time.Now()
+
+	if err = s.MultiDialer.VerifyGoogleCert(tlsConn.ConnectionState().PeerCertificates); err != nil {
+		return err
+	}
+
+	// let the dialer prefer the fresh ip for a while
+	s.MultiDialer.connGood(ip, end.Sub(start), end)
+
+	return nil
+}
@@ -0,0 +1,147 @@
+package helpers
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+func TestParseIPRanges(t *testing.T) {
+	ranges, err := ParseIPRanges(strings.NewReader(`
+# comment
+64.233.160.0-64.233.160.3
+108.177.8.0/30
+2404:6800:4005::1
+`))
+	if err != nil {
+		t.Fatalf("ParseIPRanges error: %+v", err)
+	}
+
+	if len(ranges) != 3 {
+		t.Fatalf("ParseIPRanges should return 3 ranges, got %#v", ranges)
+	}
+
+	rnd := mathrand.New(mathrand.NewSource(1))
+	for _, r := range ranges {
+		for i := 0; i < 10; i++ {
+			ip := r.Random(rnd)
+			if ipCmp(ip, r.First) < 0 || ipCmp(ip, r.Last) > 0 {
+				t.Errorf("%v.Random() should be in the range, got %v", r, ip)
+			}
+		}
+	}
+
+	if _, err := ParseIPRanges(strings.NewReader("64.233.160.3-64.233.160.0\n")); err == nil {
+		t.Errorf("ParseIPRanges should reject a reversed range")
+	}
+}
+
+func TestIPScanner(t *testing.T) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Google Internet Authority Test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "www.google.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der, caDER}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatalf("tls.Listen error: %+v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	md := &MultiDialer{
+		Resolver:        &Resolver{LRUCache: lrucache.NewLRUCache(16)},
+		IPBlackList:     lrucache.NewLRUCache(16),
+		TLSConnDuration: lrucache.NewLRUCache(16),
+		TLSConnError:    lrucache.NewLRUCache(16),
+		HostMap:         map[string][]string{"google_hk": {"192.0.2.1"}},
+		GoodConnExpiry:  time.Minute,
+	}
+	md.IPBlackList.Set("192.0.2.1", struct{}{}, time.Time{})
+
+	s := &IPScanner{
+		MultiDialer: md,
+		Aliases:     []string{"google_hk"},
+		Ranges:      []IPRange{{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.1")}},
+		Port:        port,
+		TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+		MinGoodIPs:  1,
+		MaxNewIPs:   1,
+		MaxProbes:   10,
+		Concurrency: 2,
+		Rate:        100,
+		Timeout:     time.Second,
+		Interval:    time.Hour,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 50; i++ {
+		if hosts, _ := md.LookupAlias("google_hk"); len(hosts) > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+
+	if hosts, err := md.LookupAlias("google_hk"); err != nil || len(hosts) != 1 || hosts[0] != "127.0.0.1" {
+		t.Errorf("IPScanner should add 127.0.0.1 to google_hk, got %#v, %+v", hosts, err)
+	}
+
+	md.BlackListIP("127.0.0.1", time.Time{})
+	s.prune("google_hk")
+
+	if hosts := md.HostMap["google_hk"]; len(hosts) != 1 || hosts[0] != "192.0.2.1" {
+		t.Errorf("IPScanner should remove the blacklisted 127.0.0.1 from google_hk, got %#v", hosts)
+	}
+}
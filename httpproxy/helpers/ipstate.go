@@ -0,0 +1,121 @@
+package helpers
+
+import (
+	"errors"
+	"time"
+)
+
+// IPState is what a MultiDialer knows about an IP, which is snapshotted by
+// IPStates and restored by SetIPStates across restarts.
+type IPState struct {
+	Handshake       time.Duration
+	LastSuccess     time.Time
+	LastError       time.Time
+	Error           string
+	ErrorCount      int
+	BlackListed     bool
+	BlackListExpiry time.Time
+}
+
+func (d *MultiDialer) ipState(host string) *IPState {
+	if d.ipStates == nil {
+		d.ipStates = make(map[string]*IPState)
+	}
+	s, ok := d.ipStates[host]
+	if !ok {
+		s = new(IPState)
+		d.ipStates[host] = s
+	}
+	return s
+}
+
+// connGood records a handshake with host which has succeeded at end.
+func (d *MultiDialer) connGood(host string, duration time.Duration, end time.Time) {
+	d.TLSConnError.Del(host)
+	d.TLSConnDuration.Set(host, duration, end.Add(d.GoodConnExpiry))
+
+	d.ipStatesMu.Lock()
+	s := d.ipState(host)
+	s.Handshake = duration
+	s.LastSuccess = end
+	s.ErrorCount = 0
+	d.ipStatesMu.Unlock()
+}
+
+// connError records a dial or handshake with host which has failed at end.
+func (d *MultiDialer) connError(host string, err error, end time.Time) {
+	d.TLSConnDuration.Del(host)
+	d.TLSConnError.Set(host, err, end.Add(d.ErrorConnExpiry))
+
+	d.ipStatesMu.Lock()
+	s := d.ipState(host)
+	s.LastError = end
+	s.Error = err.Error()
+	s.ErrorCount++
+	d.ipStatesMu.Unlock()
+}
+
+// IPStates returns the states of the IPs which are still in TLSConnDuration,
+// TLSConnError or IPBlackList, so the entries which have expired or have been
+// cleared are left out. The blacklist entries which never expire, like the
+// ones of a failed certificate verification, expire ErrorConnExpiry after the
+// snapshot instead, lest a single bad handshake lasts across all restarts.
+func (d *MultiDialer) IPStates() map[string]IPState {
+	d.ipStatesMu.Lock()
+	defer d.ipStatesMu.Unlock()
+
+	now := time.Now()
+
+	states := make(map[string]IPState, len(d.ipStates))
+	for host, s := range d.ipStates {
+		s1 := *s
+
+		_, good := d.TLSConnDuration.GetNotStale(host)
+		_, bad := d.TLSConnError.GetNotStale(host)
+		if !good {
+			s1.Handshake, s1.LastSuccess = 0, time.Time{}
+		}
+		if !bad {
+			s1.LastError, s1.Error, s1.ErrorCount = time.Time{}, "", 0
+		}
+		if _, ok := d.IPBlackList.GetQuiet(host); !ok {
+			s1.BlackListed, s1.BlackListExpiry = false, time.Time{}
+		} else if s1.BlackListExpiry.IsZero() {
+			s1.BlackListExpiry = now.Add(d.ErrorConnExpiry)
+		}
+
+		if !good && !bad && !s1.BlackListed {
+			delete(d.ipStates, host)
+			continue
+		}
+
+		states[host] = s1
+	}
+
+	return states
+}
+
+// SetIPStates restores states into TLSConnDuration, TLSConnError and
+// IPBlackList, except the ones which GoodConnExpiry, ErrorConnExpiry or
+// BlackListExpiry have aged out by now. The restored blacklist entries are not
+// counted as insertions.
+func (d *MultiDialer) SetIPStates(states map[string]IPState) {
+	now := time.Now()
+
+	for host, s := range states {
+		if !s.LastSuccess.IsZero() && s.LastSuccess.Add(d.GoodConnExpiry).After(now) {
+			d.connGood(host, s.Handshake, s.LastSuccess)
+		}
+
+		if !s.LastError.IsZero() && s.LastError.Add(d.ErrorConnExpiry).After(now) && s.LastError.After(s.LastSuccess) {
+			d.connError(host, errors.New(s.Error), s.LastError)
+			d.ipStatesMu.Lock()
+			d.ipState(host).ErrorCount = s.ErrorCount
+			d.ipStatesMu.Unlock()
+		}
+
+		if s.BlackListed && s.BlackListExpiry.After(now) {
+			d.blackListIP(host, s.BlackListExpiry)
+		}
+	}
+}
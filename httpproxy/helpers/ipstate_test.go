@@ -0,0 +1,68 @@
+package helpers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+func newTestMultiDialer() *MultiDialer {
+	return &MultiDialer{
+		IPBlackList:     lrucache.NewLRUCache(16),
+		TLSConnDuration: lrucache.NewLRUCache(16),
+		TLSConnError:    lrucache.NewLRUCache(16),
+		GoodConnExpiry:  time.Hour,
+		ErrorConnExpiry: time.Minute,
+	}
+}
+
+func TestIPStates(t *testing.T) {
+	now := time.Now()
+
+	md := newTestMultiDialer()
+	md.connGood("192.0.2.1", 100*time.Millisecond, now)
+	md.connError("192.0.2.2", errors.New("timeout"), now)
+	md.connError("192.0.2.2", errors.New("timeout"), now)
+	md.BlackListIP("192.0.2.3", now.Add(time.Hour))
+	md.connError("192.0.2.4", errors.New("reset"), now.Add(-2*time.Minute))
+
+	states := md.IPStates()
+
+	if s := states["192.0.2.1"]; s.Handshake != 100*time.Millisecond || !s.LastSuccess.Equal(now) {
+		t.Errorf("IPStates should keep the handshake of 192.0.2.1, got %#v", s)
+	}
+	if s := states["192.0.2.2"]; s.ErrorCount != 2 || s.Error != "timeout" {
+		t.Errorf("IPStates should count the errors of 192.0.2.2, got %#v", s)
+	}
+	if s := states["192.0.2.3"]; !s.BlackListed {
+		t.Errorf("IPStates should keep the blacklist of 192.0.2.3, got %#v", s)
+	}
+	if s, ok := states["192.0.2.4"]; ok {
+		t.Errorf("IPStates should age out the error of 192.0.2.4, got %#v", s)
+	}
+
+	// an error older than ErrorConnExpiry is not restored
+	states["192.0.2.5"] = IPState{LastError: now.Add(-2 * time.Minute), Error: "reset", ErrorCount: 1}
+
+	md1 := newTestMultiDialer()
+	md1.SetIPStates(states)
+
+	if v, ok := md1.TLSConnDuration.GetNotStale("192.0.2.1"); !ok || v.(time.Duration) != 100*time.Millisecond {
+		t.Errorf("SetIPStates should restore the handshake of 192.0.2.1, got %#v", v)
+	}
+	if _, ok := md1.TLSConnError.GetNotStale("192.0.2.2"); !ok {
+		t.Errorf("SetIPStates should restore the error of 192.0.2.2")
+	}
+	if _, ok := md1.IPBlackList.GetQuiet("192.0.2.3"); !ok {
+		t.Errorf("SetIPStates should restore the blacklist of 192.0.2.3")
+	}
+	if _, ok := md1.TLSConnError.GetNotStale("192.0.2.5"); ok {
+		t.Errorf("SetIPStates should drop the aged out error of 192.0.2.5")
+	}
+
+	if s := md1.IPStates()["192.0.2.2"]; s.ErrorCount != 2 {
+		t.Errorf("SetIPStates should restore the error count of 192.0.2.2, got %#v", s)
+	}
+}
@@ -1,7 +1,9 @@
 package helpers
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
@@ -14,10 +16,19 @@ const (
 	backlog = 1024
 )
 
+var (
+	ErrListenerClosed = errors.New("httpproxy.Listener: use of closed network connection")
+)
+
 type Listener interface {
 	net.Listener
 
 	Add(net.Conn) error
+
+	// Shutdown stops accepting and waits for all accepted connections,
+	// including hijacked ones, to be closed. When ctx is done first, the
+	// remaining connections are closed forcibly.
+	Shutdown(ctx context.Context) error
 }
 
 type connRacer struct {
@@ -28,12 +39,16 @@ type connRacer struct {
 type listener struct {
 	ln              net.Listener
 	lane            chan connRacer
+	done            chan struct{}
 	keepAlivePeriod time.Duration
 	readBufferSize  int
 	writeBufferSize int
+	trustedProxies  []*net.IPNet
 	stopped         bool
 	once            sync.Once
 	mu              sync.Mutex
+	conns           map[*trackedConn]struct{}
+	connsMu         sync.Mutex
 }
 
 type ListenOptions struct {
@@ -41,6 +56,13 @@ type ListenOptions struct {
 	KeepAlivePeriod time.Duration
 	ReadBufferSize  int
 	WriteBufferSize int
+	// Transparent sets IP_TRANSPARENT for iptables TPROXY, Linux only.
+	Transparent bool
+	// ProxyProtocol reads the PROXY protocol v1/v2 headers sent by the
+	// TrustedProxies, and reports the client addresses in them as the
+	// RemoteAddr of accepted connections.
+	ProxyProtocol  bool
+	TrustedProxies []*net.IPNet
 }
 
 func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
@@ -49,21 +71,29 @@ func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
 		return nil, err
 	}
 
+	if opts != nil && opts.ProxyProtocol && len(opts.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("ListenTCP(%#v): ProxyProtocol requires TrustedProxies", addr)
+	}
+
 	ln0, err := net.ListenTCP(network, laddr)
 	if err != nil {
 		return nil, err
 	}
 
-	var ln net.Listener
-	if opts != nil && opts.TLSConfig != nil {
-		ln = tls.NewListener(ln0, opts.TLSConfig)
-	} else {
-		ln = ln0
+	if opts != nil && opts.Transparent {
+		if err := setTransparent(ln0); err != nil {
+			ln0.Close()
+			return nil, err
+		}
 	}
 
 	var keepAlivePeriod time.Duration
 	var readBufferSize, writeBufferSize int
+	var trustedProxies []*net.IPNet
 	if opts != nil {
+		if opts.ProxyProtocol {
+			trustedProxies = opts.TrustedProxies
+		}
 		if opts.KeepAlivePeriod > 0 {
 			keepAlivePeriod = opts.KeepAlivePeriod
 		}
@@ -76,14 +106,23 @@ func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
 	}
 
 	l := &listener{
-		ln:              ln,
 		lane:            make(chan connRacer, backlog),
+		done:            make(chan struct{}),
 		stopped:         false,
 		keepAlivePeriod: keepAlivePeriod,
 		readBufferSize:  readBufferSize,
 		writeBufferSize: writeBufferSize,
+		trustedProxies:  trustedProxies,
+		conns:           make(map[*trackedConn]struct{}),
 	}
 
+	var ln net.Listener = &trackedListener{ln0, l}
+	if opts != nil && opts.TLSConfig != nil {
+		ln = tls.NewListener(ln, opts.TLSConfig)
+	}
+
+	l.ln = ln
+
 	return l, nil
 
 }
@@ -94,7 +133,21 @@ func (l *listener) Accept() (c net.Conn, err error) {
 			var tempDelay time.Duration
 			for {
 				conn, err := l.ln.Accept()
-				l.lane <- connRacer{conn, err}
+				select {
+				case l.lane <- connRacer{conn, err}:
+					// Close may have drained the lane just before
+					select {
+					case <-l.done:
+						l.drain()
+						return
+					default:
+					}
+				case <-l.done:
+					if conn != nil {
+						conn.Close()
+					}
+					return
+				}
 				if err != nil {
 					if ne, ok := err.(net.Error); ok && ne.Temporary() {
 						if tempDelay == 0 {
@@ -115,27 +168,20 @@ func (l *listener) Accept() (c net.Conn, err error) {
 		}()
 	})
 
-	r := <-l.lane
-	if r.err != nil {
-		return r.conn, r.err
-	}
-
-	if l.keepAlivePeriod > 0 || l.readBufferSize > 0 || l.writeBufferSize > 0 {
-		if tc, ok := r.conn.(*net.TCPConn); ok {
-			if l.keepAlivePeriod > 0 {
-				tc.SetKeepAlive(true)
-				tc.SetKeepAlivePeriod(l.keepAlivePeriod)
-			}
-			if l.readBufferSize > 0 {
-				tc.SetReadBuffer(l.readBufferSize)
-			}
-			if l.writeBufferSize > 0 {
-				tc.SetWriteBuffer(l.writeBufferSize)
+	select {
+	case r := <-l.lane:
+		if r.err != nil {
+			// the accept error may race with done after Close
+			select {
+			case <-l.done:
+				return nil, ErrListenerClosed
+			default:
 			}
 		}
+		return r.conn, r.err
+	case <-l.done:
+		return nil, ErrListenerClosed
 	}
-
-	return r.conn, nil
 }
 
 func (l *listener) Close() error {
@@ -145,10 +191,26 @@ func (l *listener) Close() error {
 		return nil
 	}
 	l.stopped = true
-	close(l.lane)
+	close(l.done)
+	l.drain()
 	return l.ln.Close()
 }
 
+// drain closes the connections which are left in the lane, since Accept will
+// never return them after Close.
+func (l *listener) drain() {
+	for {
+		select {
+		case r := <-l.lane:
+			if r.conn != nil {
+				r.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
 func (l *listener) Addr() net.Addr {
 	return l.ln.Addr()
 }
@@ -165,3 +227,101 @@ func (l *listener) Add(conn net.Conn) error {
 
 	return nil
 }
+
+func (l *listener) Shutdown(ctx context.Context) error {
+	l.Close()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		l.connsMu.Lock()
+		n := len(l.conns)
+		l.connsMu.Unlock()
+
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			l.connsMu.Lock()
+			conns := make([]*trackedConn, 0, len(l.conns))
+			for c := range l.conns {
+				conns = append(conns, c)
+			}
+			l.connsMu.Unlock()
+
+			glog.Warningf("httpproxy.Listener: Shutdown(%s) force close %d connections", l.Addr(), len(conns))
+			for _, c := range conns {
+				c.Close()
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// trackedListener records every accepted connection in its listener until
+// the connection is closed, so that Shutdown can drain hijacked connections
+// which net/http no longer knows about.
+type trackedListener struct {
+	net.Listener
+	l *listener
+}
+
+func (ln *trackedListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+
+	l := ln.l
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if l.keepAlivePeriod > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.keepAlivePeriod)
+		}
+		if l.readBufferSize > 0 {
+			tc.SetReadBuffer(l.readBufferSize)
+		}
+		if l.writeBufferSize > 0 {
+			tc.SetWriteBuffer(l.writeBufferSize)
+		}
+	}
+
+	// connections from the other sources keep their own address, so that
+	// clients cannot spoof one
+	if len(l.trustedProxies) > 0 && isTrustedProxy(conn.RemoteAddr(), l.trustedProxies) {
+		conn = newProxyProtocolConn(conn)
+	}
+
+	c := &trackedConn{Conn: conn, l: l}
+
+	l.connsMu.Lock()
+	l.conns[c] = struct{}{}
+	l.connsMu.Unlock()
+
+	return c, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	l    *listener
+	once sync.Once
+}
+
+// NetConn returns the underlying connection of c.
+func (c *trackedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.l.connsMu.Lock()
+		delete(c.l.conns, c)
+		c.l.connsMu.Unlock()
+	})
+	return c.Conn.Close()
+}
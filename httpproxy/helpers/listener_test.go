@@ -0,0 +1,86 @@
+package helpers
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func dialListener(t *testing.T) (Listener, net.Conn, net.Conn) {
+	ln, err := ListenTCP("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("ListenTCP error: %+v", err)
+	}
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(%#v) error: %+v", ln.Addr().String(), err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("ln.Accept() error: %+v", err)
+	}
+
+	return ln, c, conn
+}
+
+func TestListenerShutdownWait(t *testing.T) {
+	ln, c, conn := dialListener(t)
+	defer c.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := ln.Shutdown(ctx); err != nil {
+		t.Errorf("ln.Shutdown() should wait for conn closed, got %+v", err)
+	}
+
+	if _, err := ln.Accept(); err != ErrListenerClosed {
+		t.Errorf("ln.Accept() after Shutdown should return ErrListenerClosed, got %+v", err)
+	}
+}
+
+func TestListenerShutdownDrain(t *testing.T) {
+	ln, c, conn := dialListener(t)
+	defer c.Close()
+	conn.Close()
+
+	// accepted into the lane, but never returned by Accept
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(%#v) error: %+v", ln.Addr().String(), err)
+	}
+	defer c1.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := ln.Shutdown(ctx); err != nil || time.Since(start) > time.Second {
+		t.Errorf("ln.Shutdown() should close the connections left in the lane, got %+v after %v", err, time.Since(start))
+	}
+}
+
+func TestListenerShutdownForceClose(t *testing.T) {
+	ln, c, conn := dialListener(t)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := ln.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("ln.Shutdown() should return context.DeadlineExceeded, got %+v", err)
+	}
+
+	if _, err := conn.Write([]byte("x")); err == nil {
+		t.Errorf("conn should be closed by ln.Shutdown()")
+	}
+}
@@ -0,0 +1,223 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	proxyProtocolV1MaxLen      int           = 107
+	proxyProtocolV2HeaderLen   int           = 16
+	proxyProtocolHeaderTimeout time.Duration = 10 * time.Second
+)
+
+var (
+	proxyProtocolV1Signature = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// ReadProxyHeader consumes the PROXY protocol v1 or v2 header at the head of
+// br, and returns the client address in it. It returns a nil address if br
+// does not start with a header, or if the header carries no address, like
+// the health checks of the load balancer.
+func ReadProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b[0] {
+	case proxyProtocolV1Signature[0]:
+		if b, err = br.Peek(len(proxyProtocolV1Signature)); err != nil || !bytes.Equal(b, proxyProtocolV1Signature) {
+			return nil, nil
+		}
+		return readProxyHeaderV1(br)
+	case proxyProtocolV2Signature[0]:
+		if b, err = br.Peek(len(proxyProtocolV2Signature)); err != nil || !bytes.Equal(b, proxyProtocolV2Signature) {
+			return nil, nil
+		}
+		return readProxyHeaderV2(br)
+	default:
+		return nil, nil
+	}
+}
+
+// readProxyHeaderV1 reads a line like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLen {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%v: %#v", ErrInvalidProxyHeader, string(line))
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("%v: %#v", ErrInvalidProxyHeader, string(line))
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 reads the binary header, its TLVs are skipped.
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, proxyProtocolV2HeaderLen)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("%v: version %d", ErrInvalidProxyHeader, hdr[12]>>4)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, err
+	}
+
+	// the LOCAL command is sent by the load balancer itself
+	if hdr[12]&0x0f == 0x00 {
+		return nil, nil
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+
+	if len(data) < 2*ipLen+4 {
+		return nil, fmt.Errorf("%v: address length %d", ErrInvalidProxyHeader, len(data))
+	}
+
+	return &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLen:])),
+	}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header of a trusted load
+// balancer on the first Read or RemoteAddr, and reports the client address
+// in it as RemoteAddr.
+type proxyProtocolConn struct {
+	net.Conn
+	br       *bufio.Reader
+	once     sync.Once
+	raddr    net.Addr
+	err      error
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func newProxyProtocolConn(conn net.Conn) *proxyProtocolConn {
+	return &proxyProtocolConn{
+		Conn: conn,
+		br:   bufio.NewReader(conn),
+	}
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+
+	c.raddr, c.err = ReadProxyHeader(c.br)
+	if c.err != nil {
+		glog.Warningf("httpproxy.Listener: %s ReadProxyHeader error: %+v", c.Conn.RemoteAddr(), c.err)
+	}
+
+	// restore the deadline which the server may have set meanwhile
+	c.mu.Lock()
+	c.Conn.SetReadDeadline(c.deadline)
+	c.mu.Unlock()
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.raddr != nil {
+		return c.raddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// NetConn returns the underlying connection of c.
+func (c *proxyProtocolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxyProtocolConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtocolConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// isTrustedProxy reports whether addr is one of the load balancers in nets.
+func isTrustedProxy(addr net.Addr, nets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package helpers
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := "\r\n\r\n\x00\r\nQUIT\n" +
+		"\x21\x11\x00\x0c" + // PROXY over TCP4, 12 bytes of addresses
+		"\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\xdc\x04" + "\x01\xbb"
+
+	cases := []struct {
+		header string
+		addr   string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324"},
+		{"PROXY UNKNOWN\r\n", ""},
+		{v2, "192.0.2.1:56324"},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		br := bufio.NewReader(strings.NewReader(c.header + "GET / HTTP/1.1\r\n"))
+
+		addr, err := ReadProxyHeader(br)
+		if err != nil {
+			t.Errorf("ReadProxyHeader(%#v) error: %+v", c.header, err)
+			continue
+		}
+		if (addr == nil && c.addr != "") || (addr != nil && addr.String() != c.addr) {
+			t.Errorf("ReadProxyHeader(%#v) should return %#v, got %v", c.header, c.addr, addr)
+		}
+		if rest, _ := ioutil.ReadAll(br); string(rest) != "GET / HTTP/1.1\r\n" {
+			t.Errorf("ReadProxyHeader(%#v) should consume the header only, left %#v", c.header, string(rest))
+		}
+	}
+
+	if _, err := ReadProxyHeader(bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.1\r\n"))); err == nil {
+		t.Errorf("ReadProxyHeader should reject a malformed header")
+	}
+}
+
+func TestListenerProxyProtocol(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+
+	ln, err := ListenTCP("tcp", "127.0.0.1:0", &ListenOptions{ProxyProtocol: true, TrustedProxies: []*net.IPNet{loopback}})
+	if err != nil {
+		t.Fatalf("ListenTCP error: %+v", err)
+	}
+	defer ln.Close()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(%#v) error: %+v", ln.Addr().String(), err)
+	}
+	defer c.Close()
+
+	io.WriteString(c, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("ln.Accept() error: %+v", err)
+	}
+	defer conn.Close()
+
+	if addr := conn.RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr should be the client in the PROXY header, got %#v", addr)
+	}
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Errorf("conn should read the data after the PROXY header, got %#v, %+v", string(b), err)
+	}
+
+	// stripssl re-injects the hijacked connection wrapped by crypto/tls
+	if err := ln.Add(struct{ net.Conn }{conn}); err != nil {
+		t.Fatalf("ln.Add error: %+v", err)
+	}
+
+	conn1, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("ln.Accept() error: %+v", err)
+	}
+
+	if addr := conn1.RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr of the re-injected conn should be kept, got %#v", addr)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("OriginalDst: not supported on %s", runtime.GOOS)
+}
+
+func setTransparent(ln *net.TCPListener) error {
+	return fmt.Errorf("IP_TRANSPARENT: not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,92 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// OriginalDst returns the destination of conn before it was redirected by
+// an iptables REDIRECT rule. The wrappers of the listener, like the PROXY
+// protocol one, are unwrapped by their NetConn.
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	for {
+		c, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = c.NetConn()
+	}
+
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("OriginalDst: %T is not a *net.TCPConn", conn)
+	}
+
+	cc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var err1 error
+
+	fn := func(s uintptr) {
+		if laddr, ok := tc.LocalAddr().(*net.TCPAddr); ok && laddr.IP.To4() == nil {
+			var mtuinfo *unix.IPv6MTUInfo
+			mtuinfo, err1 = unix.GetsockoptIPv6MTUInfo(int(s), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+			if err1 == nil {
+				sa := mtuinfo.Addr
+				port := int(sa.Port>>8) | int(sa.Port&0xff)<<8
+				addr = &net.TCPAddr{IP: net.IP(sa.Addr[:]), Port: port}
+			}
+			return
+		}
+
+		// struct sockaddr_in fits in struct ipv6_mreq
+		var mreq *unix.IPv6Mreq
+		mreq, err1 = unix.GetsockoptIPv6Mreq(int(s), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if err1 == nil {
+			sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(&mreq.Multiaddr[0]))
+			port := int(sa.Port>>8) | int(sa.Port&0xff)<<8
+			addr = &net.TCPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: port}
+		}
+	}
+
+	if err := cc.Control(fn); err != nil {
+		return nil, err
+	}
+
+	if err1 != nil {
+		return nil, err1
+	}
+
+	return addr, nil
+}
+
+// setTransparent sets IP_TRANSPARENT on ln, so that it accepts connections
+// diverted by an iptables TPROXY rule.
+func setTransparent(ln *net.TCPListener) error {
+	cc, err := ln.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var err1 error
+	fn := func(s uintptr) {
+		if err1 = unix.SetsockoptInt(int(s), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err1 != nil {
+			return
+		}
+		if laddr, ok := ln.Addr().(*net.TCPAddr); ok && laddr.IP.To4() == nil {
+			err1 = unix.SetsockoptInt(int(s), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		}
+	}
+
+	if err := cc.Control(fn); err != nil {
+		return err
+	}
+
+	return err1
+}
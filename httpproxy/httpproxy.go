@@ -1,48 +1,307 @@
 package httpproxy
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/phuslu/glog"
 
 	"./filters"
 	"./helpers"
+	"./storage"
 
+	_ "./filters/accesslog"
 	_ "./filters/auth"
 	_ "./filters/autoproxy"
 	_ "./filters/autorange"
 	_ "./filters/direct"
 	_ "./filters/gae"
 	_ "./filters/php"
+	_ "./filters/ratelimit"
 	_ "./filters/rewrite"
+	_ "./filters/rules"
 	_ "./filters/ssh2"
 	_ "./filters/stripssl"
 	_ "./filters/vps"
 )
 
+const (
+	ConfigFilename string = "httpproxy.json"
+)
+
 type Config struct {
 	Enabled          bool
 	Address          string
 	KeepAlivePeriod  int
 	ReadTimeout      int
 	WriteTimeout     int
+	ShutdownTimeout  int
+	EnableSocks      bool
+	Transparent      string
 	RequestFilters   []string
 	RoundTripFilters []string
 	ResponseFilters  []string
+	TLS              struct {
+		Enabled       bool
+		CertFile      string
+		KeyFile       string
+		IssueByRootCA bool
+		ServerName    string
+		ClientCAFile  string
+	}
+	ProxyProtocol struct {
+		Enabled        bool
+		TrustedProxies []string
+	}
+	Fallthrough struct {
+		Errors      []string
+		MaxBodySize int64
+	}
+	Trace struct {
+		Header     string
+		AllowedIPs []string
+		Verbosity  int
+	}
+	Stores map[string]struct {
+		URL       string
+		EnablePut bool
+	}
+}
+
+// profile serves requests with the current Handler, which Reload may swap
+// while requests already being served keep the Handler they started with.
+type profile struct {
+	config  Config
+	handler atomic.Value
+	server  *http.Server
+}
+
+func (p *profile) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.handler.Load().(Handler).ServeHTTP(rw, req)
+}
+
+var (
+	profiles   = make(map[string]*profile)
+	profilesMu sync.Mutex
+	reloadMu   sync.Mutex
+
+	remoteStores   = make(map[string]*storage.HTTPStore)
+	remoteStoresMu sync.Mutex
+)
+
+// ReadConfig reads the profiles, and sets their Stores as the remote stores of
+// the filters.
+func ReadConfig() (map[string]Config, error) {
+	config, stores, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	setRemoteStores(stores)
+	return config, nil
+}
+
+// readConfig reads the profiles, and the remote stores of their Stores, which
+// are left to the caller to set.
+func readConfig() (map[string]Config, map[string]*storage.HTTPStore, error) {
+	config := make(map[string]Config)
+	err := storage.LookupStoreByFilterName("httpproxy").UnmarshallJson(ConfigFilename, &config)
+	if err != nil {
+		return nil, nil, err
+	}
+	stores, err := newRemoteStores(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, stores, nil
+}
+
+// newRemoteStores returns the remote stores of the Stores of the enabled
+// profiles, by filter name. The remote stores which are set already are
+// reused if their URL and EnablePut are unchanged, so that they keep knowing
+// whether their servers are reachable.
+func newRemoteStores(config map[string]Config) (map[string]*storage.HTTPStore, error) {
+	remoteStoresMu.Lock()
+	defer remoteStoresMu.Unlock()
+
+	stores := make(map[string]*storage.HTTPStore)
+	for _, c := range config {
+		if !c.Enabled {
+			continue
+		}
+		for name, sc := range c.Stores {
+			store, err := storage.NewHTTPStore(sc.URL, filepath.Join(storage.RemoteStoreCacheDir, name))
+			if err != nil {
+				return nil, fmt.Errorf("Stores %#v error: %+v", name, err)
+			}
+			store.EnablePut = sc.EnablePut
+			if store0, ok := remoteStores[name]; ok && store0.URL == store.URL && store0.EnablePut == store.EnablePut {
+				store = store0
+			}
+			stores[name] = store
+		}
+	}
+
+	return stores, nil
 }
 
-func ServeProfile(config Config, branding string) error {
+// setRemoteStores sets stores as the remote stores of their filters, and
+// unsets the ones which are not in stores. It returns the func to set back
+// the remote stores which were set before.
+func setRemoteStores(stores map[string]*storage.HTTPStore) (restore func()) {
+	remoteStoresMu.Lock()
+	defer remoteStoresMu.Unlock()
+
+	set := func(stores map[string]*storage.HTTPStore) {
+		for name, store := range stores {
+			storage.SetRemoteStore(name, store)
+		}
+		for name := range remoteStores {
+			if _, ok := stores[name]; !ok {
+				storage.SetRemoteStore(name, nil)
+			}
+		}
+		remoteStores = stores
+	}
+
+	stores0 := remoteStores
+	set(stores)
 
-	listenOpts := &helpers.ListenOptions{TLSConfig: nil}
+	return func() {
+		remoteStoresMu.Lock()
+		defer remoteStoresMu.Unlock()
+		set(stores0)
+	}
+}
+
+func ServeProfile(name string, config Config, branding string) error {
+
+	tlsConfig, err := NewTLSConfig(config)
+	if err != nil {
+		glog.Fatalf("NewTLSConfig(%#v) error: %+v", name, err)
+	}
+
+	switch config.Transparent {
+	case "", TransparentRedirect, TransparentTProxy:
+	default:
+		glog.Fatalf("profile %#v Transparent should be %#v or %#v, got %#v", name, TransparentRedirect, TransparentTProxy, config.Transparent)
+	}
+
+	listenOpts := &helpers.ListenOptions{
+		TLSConfig:     tlsConfig,
+		Transparent:   config.Transparent == TransparentTProxy,
+		ProxyProtocol: config.ProxyProtocol.Enabled,
+	}
+
+	listenOpts.TrustedProxies, err = parseCIDRs(config.ProxyProtocol.TrustedProxies)
+	if err != nil {
+		glog.Fatalf("profile %#v ProxyProtocol error: %+v", name, err)
+	}
 
 	ln, err := helpers.ListenTCP("tcp", config.Address, listenOpts)
 	if err != nil {
 		glog.Fatalf("ListenTCP(%s, %#v) error: %s", config.Address, listenOpts, err)
 	}
 
+	h, err := NewHandler(name, config, ln, branding)
+	if err != nil {
+		glog.Fatalf("NewHandler(%#v) error: %+v", name, err)
+	}
+
+	p := &profile{config: config}
+	p.handler.Store(h)
+
+	filters.Start()
+
+	p.server = &http.Server{
+		Handler:        p,
+		ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
+		WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	profilesMu.Lock()
+	profiles[name] = p
+	profilesMu.Unlock()
+
+	var ln1 net.Listener = h.Listener
+	switch {
+	case config.Transparent != "":
+		ln1 = newTransparentListener(h.Listener, p, config.Transparent, time.Duration(config.ReadTimeout)*time.Second)
+	case config.EnableSocks:
+		ln1 = newSocksListener(h.Listener, p, time.Duration(config.ReadTimeout)*time.Second)
+	}
+
+	return p.server.Serve(ln1)
+}
+
+// Shutdown stops all profiles from accepting new connections, then waits for
+// active requests and hijacked tunnels to finish. Connections still open
+// after the ShutdownTimeout of their profile are closed forcibly.
+func Shutdown() {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+
+	if adminServer != nil {
+		adminServer.Close()
+	}
+
+	var wg sync.WaitGroup
+	for name, p := range profiles {
+		wg.Add(1)
+		go func(name string, p *profile) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.config.ShutdownTimeout)*time.Second)
+			defer cancel()
+
+			ln := p.handler.Load().(Handler).Listener
+
+			glog.Infof("httpproxy: profile %#v shutting down, draining connections on %s", name, ln.Addr())
+
+			go p.server.Shutdown(ctx)
+			if err := ln.Shutdown(ctx); err != nil {
+				glog.Warningf("httpproxy: profile %#v Shutdown error: %+v", name, err)
+			}
+		}(name, p)
+	}
+	wg.Wait()
+
+	filters.Stop()
+}
+
+// parseCIDRs parses a list of CIDRs, in which bare IPs are single hosts.
+func parseCIDRs(ss []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ss))
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("net.ParseCIDR(%#v) error: %+v", s, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func NewHandler(name string, config Config, ln helpers.Listener, branding string) (Handler, error) {
 	h := Handler{
+		Profile:          name,
 		Listener:         ln,
+		Transparent:      config.Transparent != "",
 		RequestFilters:   []filters.RequestFilter{},
 		RoundTripFilters: []filters.RoundTripFilter{},
 		ResponseFilters:  []filters.ResponseFilter{},
@@ -51,37 +310,129 @@ func ServeProfile(config Config, branding string) error {
 
 	for _, name := range config.RequestFilters {
 		f, err := filters.GetFilter(name)
+		if err != nil {
+			return h, fmt.Errorf("filters.GetFilter(%#v) error: %+v", name, err)
+		}
 		f1, ok := f.(filters.RequestFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a RequestFilter, err=%+v", f, err)
+			return h, fmt.Errorf("%#v is not a RequestFilter", f)
 		}
 		h.RequestFilters = append(h.RequestFilters, f1)
 	}
 
 	for _, name := range config.RoundTripFilters {
 		f, err := filters.GetFilter(name)
+		if err != nil {
+			return h, fmt.Errorf("filters.GetFilter(%#v) error: %+v", name, err)
+		}
 		f1, ok := f.(filters.RoundTripFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a RoundTripFilter, err=%+v", f, err)
+			return h, fmt.Errorf("%#v is not a RoundTripFilter", f)
 		}
 		h.RoundTripFilters = append(h.RoundTripFilters, f1)
 	}
 
 	for _, name := range config.ResponseFilters {
 		f, err := filters.GetFilter(name)
+		if err != nil {
+			return h, fmt.Errorf("filters.GetFilter(%#v) error: %+v", name, err)
+		}
 		f1, ok := f.(filters.ResponseFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a ResponseFilter, err=%+v", f, err)
+			return h, fmt.Errorf("%#v is not a ResponseFilter", f)
 		}
 		h.ResponseFilters = append(h.ResponseFilters, f1)
 	}
 
-	s := &http.Server{
-		Handler:        h,
-		ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
-		WriteTimeout:   time.Duration(config.WriteTimeout) * time.Second,
-		MaxHeaderBytes: 1 << 20,
+	if len(config.Fallthrough.Errors) > 0 {
+		p, err := NewFallthroughPolicy(config.Fallthrough.Errors, config.Fallthrough.MaxBodySize)
+		if err != nil {
+			return h, fmt.Errorf("NewFallthroughPolicy(%#v) error: %+v", name, err)
+		}
+		h.Fallthrough = p
 	}
 
-	return s.Serve(h.Listener)
+	if config.Trace.Header != "" || config.Trace.Verbosity > 0 {
+		p, err := NewTracePolicy(config.Trace.Header, config.Trace.AllowedIPs, config.Trace.Verbosity)
+		if err != nil {
+			return h, fmt.Errorf("NewTracePolicy(%#v) error: %+v", name, err)
+		}
+		h.Trace = p
+	}
+
+	return h, nil
+}
+
+// Reload reads httpproxy.json and all filter configs again, then swaps the
+// filter chains of the running profiles. If any config fails to load, the
+// running filters are left untouched and the error is returned.
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	config, stores, err := readConfig()
+	if err != nil {
+		return fmt.Errorf("ReadConfig(%#v) error: %+v", ConfigFilename, err)
+	}
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+
+	// the filters are rebuilt from the new Stores, the old ones get theirs
+	// back if the reload fails
+	restoreStores := setRemoteStores(stores)
+	commit, restore := filters.Reset()
+
+	handlers := make(map[string]Handler)
+	for name, p := range profiles {
+		c, ok := config[name]
+		if !ok || !c.Enabled {
+			glog.Warningf("httpproxy: profile %#v is removed or disabled, restart to take effect", name)
+			continue
+		}
+		if c.Address != p.config.Address {
+			glog.Warningf("httpproxy: profile %#v Address changed to %#v, restart to take effect", name, c.Address)
+		}
+		if c.TLS != p.config.TLS {
+			glog.Warningf("httpproxy: profile %#v TLS changed, restart to take effect", name)
+		}
+		if c.EnableSocks != p.config.EnableSocks {
+			glog.Warningf("httpproxy: profile %#v EnableSocks changed to %v, restart to take effect", name, c.EnableSocks)
+		}
+		if c.Transparent != p.config.Transparent {
+			glog.Warningf("httpproxy: profile %#v Transparent changed to %#v, restart to take effect", name, c.Transparent)
+		}
+		if !reflect.DeepEqual(c.ProxyProtocol, p.config.ProxyProtocol) {
+			glog.Warningf("httpproxy: profile %#v ProxyProtocol changed, restart to take effect", name)
+		}
+
+		h0 := p.handler.Load().(Handler)
+		h, err := NewHandler(name, c, h0.Listener, h0.Branding)
+		if err != nil {
+			restore()
+			restoreStores()
+			return fmt.Errorf("NewHandler(%#v) error: %+v", name, err)
+		}
+		handlers[name] = h
+	}
+
+	for name, c := range config {
+		if name == AdminProfile {
+			continue
+		}
+		if _, ok := profiles[name]; !ok && c.Enabled {
+			glog.Warningf("httpproxy: profile %#v is added, restart to take effect", name)
+		}
+	}
+
+	for name, h := range handlers {
+		profiles[name].config.RequestFilters = config[name].RequestFilters
+		profiles[name].config.RoundTripFilters = config[name].RoundTripFilters
+		profiles[name].config.ResponseFilters = config[name].ResponseFilters
+		profiles[name].handler.Store(h)
+	}
+
+	commit()
+
+	return nil
 }
@@ -0,0 +1,36 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRemoteStores(t *testing.T) {
+	var config map[string]Config
+	json.Unmarshal([]byte(`{"Default": {"Enabled": true, "Stores": {"test": {"URL": "http://127.0.0.1:1/test/"}}}}`), &config)
+
+	stores, err := newRemoteStores(config)
+	if err != nil {
+		t.Fatalf("newRemoteStores error: %+v", err)
+	}
+	stores0 := remoteStores
+	restore := setRemoteStores(stores)
+
+	stores1, err := newRemoteStores(config)
+	if err != nil || stores1["test"] != stores["test"] {
+		t.Errorf("newRemoteStores should reuse the HTTPStore of an unchanged URL, got %#v, %+v", stores1, err)
+	}
+
+	config["Default"].Stores["test"] = struct {
+		URL       string
+		EnablePut bool
+	}{URL: "http://127.0.0.1:1/test2/"}
+	if stores1, err = newRemoteStores(config); err != nil || stores1["test"] == stores["test"] {
+		t.Errorf("newRemoteStores should replace the HTTPStore of a changed URL, got %#v, %+v", stores1, err)
+	}
+
+	restore()
+	if len(remoteStores) != len(stores0) {
+		t.Errorf("restore should set back the remote stores, got %#v", remoteStores)
+	}
+}
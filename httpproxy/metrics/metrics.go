@@ -0,0 +1,251 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+)
+
+var (
+	mu      sync.Mutex
+	metrics = make(map[string]metric)
+)
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func register(name string, m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: %#v already registered", name))
+	}
+	metrics[name] = m
+}
+
+// WriteText writes all registered metrics to w in the Prometheus text
+// exposition format.
+func WriteText(w io.Writer) error {
+	mu.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	ms := make([]metric, 0, len(metrics))
+	sort.Strings(names)
+	for _, name := range names {
+		ms = append(ms, metrics[name])
+	}
+	mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(rw)
+	})
+}
+
+type series struct {
+	values []string
+	count  uint64
+	sum    float64
+	counts []uint64
+}
+
+type vec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (v *vec) get(values []string) *series {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects labels %v, got values %v", v.name, v.labels, values))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ss := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		s := *v.series[key]
+		s.counts = append([]uint64(nil), s.counts...)
+		ss = append(ss, &s)
+	}
+	return ss
+}
+
+func (v *vec) writeHeader(w *bufio.Writer, typ string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(v.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, help, v.name, typ)
+}
+
+func (v *vec) writeSample(w *bufio.Writer, suffix string, values []string, le string, value float64) {
+	w.WriteString(v.name)
+	w.WriteString(suffix)
+	if len(values) > 0 || le != "" {
+		w.WriteByte('{')
+		for i, value := range values {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", v.labels[i], escapeLabelValue(value))
+		}
+		if le != "" {
+			if len(values) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "le=\"%s\"", le)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// Counter is a monotonically increasing value, partitioned by labels.
+type Counter struct {
+	vec
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*series),
+	}}
+	register(name, c)
+	return c
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %s cannot decrease", c.name))
+	}
+	c.mu.Lock()
+	c.get(labelValues).sum += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	ss := c.sorted()
+	c.mu.Unlock()
+
+	c.writeHeader(w, "counter")
+	for _, s := range ss {
+		c.writeSample(w, "", s.values, "", s.sum)
+	}
+}
+
+// Histogram counts observations into cumulative buckets, partitioned by
+// labels.
+type Histogram struct {
+	vec
+	buckets []float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		vec: vec{
+			name:   name,
+			help:   help,
+			labels: labels,
+			series: make(map[string]*series),
+		},
+		buckets: buckets,
+	}
+	register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	ss := h.sorted()
+	h.mu.Unlock()
+
+	h.writeHeader(w, "histogram")
+	for _, s := range ss {
+		var n uint64
+		for i, b := range h.buckets {
+			n += s.counts[i]
+			h.writeSample(w, "_bucket", s.values, formatFloat(b), float64(n))
+		}
+		h.writeSample(w, "_bucket", s.values, "+Inf", float64(s.count))
+		h.writeSample(w, "_sum", s.values, "", s.sum)
+		h.writeSample(w, "_count", s.values, "", float64(s.count))
+	}
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.", "code")
+	c.Inc("200")
+	c.Add(2, "502")
+	c.Inc("a\"b")
+
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 0.1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var b bytes.Buffer
+	if err := WriteText(&b); err != nil {
+		t.Fatalf("WriteText error: %+v", err)
+	}
+
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{code="200"} 1`,
+		`test_requests_total{code="502"} 2`,
+		`test_requests_total{code="a\"b"} 1`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{le="0.1"} 1`,
+		`test_duration_seconds_bucket{le="1"} 2`,
+		`test_duration_seconds_bucket{le="+Inf"} 3`,
+		"test_duration_seconds_sum 3.55",
+		"test_duration_seconds_count 3",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("WriteText output should contain %#v, got:\n%s", line, b.String())
+		}
+	}
+
+	if strings.Index(b.String(), "test_duration_seconds") > strings.Index(b.String(), "test_requests_total") {
+		t.Errorf("WriteText output should be sorted by name, got:\n%s", b.String())
+	}
+}
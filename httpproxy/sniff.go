@@ -0,0 +1,183 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"./helpers"
+)
+
+const (
+	sniffBacklog = 1024
+)
+
+// sniffListener calls sniff in a new goroutine for each accepted connection,
+// which either serves the connection itself, or passes it to Push to have it
+// returned by Accept.
+type sniffListener struct {
+	helpers.Listener
+	sniff     func(l *sniffListener, conn net.Conn)
+	lane      chan net.Conn
+	errc      chan error
+	done      chan struct{}
+	once      sync.Once
+	closeOnce sync.Once
+}
+
+func newSniffListener(ln helpers.Listener, sniff func(l *sniffListener, conn net.Conn)) *sniffListener {
+	return &sniffListener{
+		Listener: ln,
+		sniff:    sniff,
+		lane:     make(chan net.Conn, sniffBacklog),
+		errc:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *sniffListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		go l.serve()
+	})
+
+	select {
+	case conn := <-l.lane:
+		return conn, nil
+	case err := <-l.errc:
+		return nil, err
+	case <-l.done:
+		return nil, helpers.ErrListenerClosed
+	}
+}
+
+func (l *sniffListener) serve() {
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
+				}
+				glog.Warningf("httpproxy.sniffListener: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			l.errc <- err
+			return
+		}
+		tempDelay = 0
+		go l.sniff(l, conn)
+	}
+}
+
+func (l *sniffListener) Push(conn net.Conn) {
+	select {
+	case l.lane <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniffListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// bufferedConn reads the bytes buffered by sniffing before reading from Conn.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// serveConnect serves the CONNECT request req, which was made up from conn,
+// with handler. The status code of the CONNECT response is passed to reply
+// instead of being written to conn.
+func serveConnect(conn net.Conn, br *bufio.Reader, req *http.Request, handler http.Handler, reply func(code int)) {
+	rw := &connectResponseWriter{
+		conn:   conn,
+		br:     br,
+		header: http.Header{},
+		reply:  reply,
+	}
+
+	// like net/http, cancel the context of req once the handler returns, which
+	// is what the filters wait for to release the resources of req
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	handler.ServeHTTP(rw, req.WithContext(ctx))
+
+	if !rw.hijacked {
+		if !rw.wroteHeader {
+			rw.WriteHeader(http.StatusBadGateway)
+		}
+		conn.Close()
+	}
+}
+
+// connectResponseWriter hands the connection over on Hijack, the CONNECT
+// response itself is only passed to reply.
+type connectResponseWriter struct {
+	conn        net.Conn
+	br          *bufio.Reader
+	header      http.Header
+	reply       func(code int)
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (rw *connectResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *connectResponseWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.reply(code)
+}
+
+// Write discards the body of the CONNECT response, the client does not
+// speak HTTP.
+func (rw *connectResponseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return len(b), nil
+}
+
+func (rw *connectResponseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+func (rw *connectResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rw.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.hijacked = true
+	conn := &bufferedConn{rw.conn, rw.br}
+	return conn, bufio.NewReadWriter(rw.br, bufio.NewWriter(rw.conn)), nil
+}
@@ -0,0 +1,262 @@
+package httpproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"./helpers"
+)
+
+const (
+	socks4Version byte = 0x04
+	socks5Version byte = 0x05
+
+	socks5AuthNone     byte = 0x00
+	socks5AuthPassword byte = 0x02
+	socks5AuthNoAccept byte = 0xff
+
+	socksCmdConnect byte = 0x01
+
+	socks5AtypIPv4   byte = 0x01
+	socks5AtypDomain byte = 0x03
+	socks5AtypIPv6   byte = 0x04
+
+	socks5Succeeded           byte = 0x00
+	socks5GeneralFailure      byte = 0x01
+	socks5CommandNotSupported byte = 0x07
+
+	socks4Granted  byte = 0x5a
+	socks4Rejected byte = 0x5b
+)
+
+// newSocksListener returns a listener which turns SOCKS4a and SOCKS5
+// connections into CONNECT requests served by handler, and returns the
+// others from Accept for the http.Server.
+func newSocksListener(ln helpers.Listener, handler http.Handler, readTimeout time.Duration) net.Listener {
+	return newSniffListener(ln, func(l *sniffListener, conn net.Conn) {
+		if readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+
+		br := bufio.NewReader(conn)
+		b, err := br.Peek(1)
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		switch b[0] {
+		case socks4Version, socks5Version:
+			serveSocks(conn, br, handler)
+		default:
+			conn.SetReadDeadline(time.Time{})
+			l.Push(&bufferedConn{conn, br})
+		}
+	})
+}
+
+func serveSocks(conn net.Conn, br *bufio.Reader, handler http.Handler) {
+	var version byte
+	var addr, username, password string
+	var err error
+
+	version, err = br.ReadByte()
+	if err == nil {
+		switch version {
+		case socks5Version:
+			addr, username, password, err = readSocks5Request(conn, br)
+		case socks4Version:
+			addr, username, err = readSocks4Request(conn, br)
+		}
+	}
+
+	if err != nil {
+		glog.Warningf("%s SOCKS%d handshake error: %+v", conn.RemoteAddr(), version, err)
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Host:       addr,
+		RemoteAddr: conn.RemoteAddr().String(),
+		RequestURI: addr,
+	}
+
+	if username != "" || password != "" {
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+	}
+
+	serveConnect(conn, br, req, handler, func(code int) {
+		ok := code >= 200 && code < 300
+		switch version {
+		case socks5Version:
+			rep := socks5Succeeded
+			if !ok {
+				rep = socks5GeneralFailure
+			}
+			conn.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		case socks4Version:
+			rep := socks4Granted
+			if !ok {
+				rep = socks4Rejected
+			}
+			conn.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+		}
+	})
+}
+
+func readSocks5Request(conn net.Conn, br *bufio.Reader) (addr, username, password string, err error) {
+	n, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+
+	methods := make([]byte, n)
+	if _, err = io.ReadFull(br, methods); err != nil {
+		return
+	}
+
+	method := socks5AuthNoAccept
+	for _, m := range methods {
+		if m == socks5AuthPassword {
+			method = m
+			break
+		}
+		if m == socks5AuthNone {
+			method = m
+		}
+	}
+
+	if _, err = conn.Write([]byte{socks5Version, method}); err != nil {
+		return
+	}
+
+	switch method {
+	case socks5AuthNoAccept:
+		err = errors.New("no acceptable authentication methods")
+		return
+	case socks5AuthPassword:
+		// RFC 1929 username/password negotiation
+		var b [2]byte
+		if _, err = io.ReadFull(br, b[:]); err != nil {
+			return
+		}
+		u := make([]byte, b[1])
+		if _, err = io.ReadFull(br, u); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(br, b[:1]); err != nil {
+			return
+		}
+		p := make([]byte, b[0])
+		if _, err = io.ReadFull(br, p); err != nil {
+			return
+		}
+		if _, err = conn.Write([]byte{0x01, 0x00}); err != nil {
+			return
+		}
+		username, password = string(u), string(p)
+	}
+
+	var hdr [4]byte
+	if _, err = io.ReadFull(br, hdr[:]); err != nil {
+		return
+	}
+
+	if hdr[0] != socks5Version {
+		err = fmt.Errorf("invalid SOCKS5 request version %d", hdr[0])
+		return
+	}
+
+	var host string
+	switch hdr[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(br, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var n byte
+		if n, err = br.ReadByte(); err != nil {
+			return
+		}
+		b := make([]byte, n)
+		if _, err = io.ReadFull(br, b); err != nil {
+			return
+		}
+		host = string(b)
+	default:
+		err = fmt.Errorf("unsupported SOCKS5 address type %d", hdr[3])
+		return
+	}
+
+	var port uint16
+	if err = binary.Read(br, binary.BigEndian, &port); err != nil {
+		return
+	}
+
+	if hdr[1] != socksCmdConnect {
+		conn.Write([]byte{socks5Version, socks5CommandNotSupported, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		err = fmt.Errorf("unsupported SOCKS5 command %d", hdr[1])
+		return
+	}
+
+	addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return
+}
+
+func readSocks4Request(conn net.Conn, br *bufio.Reader) (addr, username string, err error) {
+	var hdr [7]byte
+	if _, err = io.ReadFull(br, hdr[:]); err != nil {
+		return
+	}
+
+	port := binary.BigEndian.Uint16(hdr[1:3])
+	ip := net.IP(hdr[3:7])
+
+	if username, err = br.ReadString(0x00); err != nil {
+		return
+	}
+	username = username[:len(username)-1]
+
+	host := ip.String()
+	// SOCKS4a, the ip is 0.0.0.x and the domain follows the userid
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		if host, err = br.ReadString(0x00); err != nil {
+			return
+		}
+		host = host[:len(host)-1]
+	}
+
+	if hdr[0] != socksCmdConnect {
+		conn.Write([]byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		err = fmt.Errorf("unsupported SOCKS4 command %d", hdr[0])
+		return
+	}
+
+	addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return
+}
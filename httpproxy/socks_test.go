@@ -0,0 +1,138 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"./helpers"
+)
+
+// echoConnectHandler answers CONNECT requests by echoing the tunnel, and
+// other requests by their RequestURI.
+type echoConnectHandler struct {
+	reqs chan *http.Request
+}
+
+func (h echoConnectHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.reqs <- req
+
+	if req.Method != http.MethodConnect {
+		io.WriteString(rw, req.RequestURI)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	rw.(http.Flusher).Flush()
+
+	conn, _, err := rw.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	io.Copy(conn, conn)
+}
+
+func startSocks(t *testing.T) (string, chan *http.Request) {
+	ln, err := helpers.ListenTCP("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("ListenTCP error: %+v", err)
+	}
+
+	h := echoConnectHandler{make(chan *http.Request, 1)}
+	sln := newSocksListener(ln, h, 0)
+	go http.Serve(sln, h)
+
+	return ln.Addr().String(), h.reqs
+}
+
+func testSocksTunnel(t *testing.T, addr string, handshake, reply []byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial(%#v) error: %+v", addr, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(handshake); err != nil {
+		t.Fatalf("conn.Write error: %+v", err)
+	}
+
+	b := make([]byte, len(reply))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("read reply error: %+v", err)
+	}
+	if !bytes.Equal(b, reply) {
+		t.Fatalf("reply should be %v, got %v", reply, b)
+	}
+
+	io.WriteString(conn, "hello")
+	b = make([]byte, 5)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hello" {
+		t.Errorf("tunnel should echo \"hello\", got %#v, %+v", string(b), err)
+	}
+}
+
+func TestSocks5Connect(t *testing.T) {
+	addr, reqs := startSocks(t)
+
+	handshake := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 11}
+	handshake = append(handshake, "example.org"...)
+	handshake = append(handshake, 0x01, 0xbb)
+
+	testSocksTunnel(t, addr, handshake, []byte{0x05, 0x00, 0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+	req := <-reqs
+	if req.Method != http.MethodConnect || req.Host != "example.org:443" {
+		t.Errorf("request should be CONNECT example.org:443, got %s %s", req.Method, req.Host)
+	}
+
+	select {
+	case <-req.Context().Done():
+	case <-time.After(time.Second):
+		t.Errorf("request context should be done once the handler returns")
+	}
+}
+
+func TestSocks4aConnect(t *testing.T) {
+	addr, reqs := startSocks(t)
+
+	handshake := []byte{0x04, 0x01, 0x00, 0x50, 0, 0, 0, 1}
+	handshake = append(handshake, "user\x00example.org\x00"...)
+
+	testSocksTunnel(t, addr, handshake, []byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0})
+
+	if req := <-reqs; req.Method != http.MethodConnect || req.Host != "example.org:80" {
+		t.Errorf("request should be CONNECT example.org:80, got %s %s", req.Method, req.Host)
+	}
+}
+
+func TestSocksListenerHTTP(t *testing.T) {
+	addr, reqs := startSocks(t)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("net.Dial(%#v) error: %+v", addr, err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET http://example.org/ HTTP/1.1\r\nHost: example.org\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse error: %+v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "http://example.org/" {
+		t.Errorf("plain HTTP should pass through, got %#v", string(body))
+	}
+
+	<-reqs
+}
@@ -0,0 +1,320 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// ConfigError is a problem of a config file found by CheckJson, Line is 0
+// if it is about the whole file.
+type ConfigError struct {
+	Filename string
+	Line     int
+	Err      error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", e.Filename, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Filename, e.Err)
+}
+
+// CheckJson validates filename and its .user override in store against the
+// type of config, and reports their syntax errors, type errors and unknown
+// keys with lines. Unless they cannot be decoded, it decodes them into config
+// like UnmarshallJson and reports ok.
+func CheckJson(store Store, filename string, config interface{}) (errs []error, ok bool) {
+	ok = true
+
+	fileext := path.Ext(filename)
+	filename1 := strings.TrimSuffix(filename, fileext) + ".user" + fileext
+
+	t := reflect.TypeOf(config)
+	for i, name := range []string{filename, filename1} {
+		resp, err := store.Get(name)
+		if err != nil {
+			if i == 0 {
+				return append(errs, &ConfigError{Filename: Path(store, name), Err: err}), false
+			}
+			continue
+		}
+		if resp.Body == nil {
+			continue
+		}
+
+		data, err := readJson(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			errs = append(errs, &ConfigError{Filename: Path(store, name), Err: err})
+			ok = false
+			continue
+		}
+		data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+		errs1, ok1 := checkJson(Path(store, name), data, t)
+		errs = append(errs, errs1...)
+		ok = ok && ok1
+	}
+
+	if !ok {
+		return errs, false
+	}
+
+	if err := readJsonConfig(store, filename, config); err != nil {
+		return append(errs, &ConfigError{Filename: Path(store, filename), Err: err}), false
+	}
+
+	return errs, true
+}
+
+// Path returns the path of name in store for messages.
+func Path(store Store, name string) string {
+	switch s := store.(type) {
+	case *FileStore:
+		return filepath.Join(s.Dirname, name)
+	case *ZipStore:
+		return filepath.Join(s.Filename, name)
+	case *HTTPStore:
+		return s.url(name)
+	case *OverlayStore:
+		if store1, err := s.lookup(name); err == nil {
+			return Path(store1, name)
+		}
+	}
+	return name
+}
+
+// checkJson decodes data into a new value of type t, and walks data along t
+// for the keys which the decoding ignores.
+func checkJson(filename string, data []byte, t reflect.Type) ([]error, bool) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	if err := d.Decode(reflect.New(t.Elem()).Interface()); err != nil {
+		var offset int64
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			offset = e.Offset
+		case *json.UnmarshalTypeError:
+			offset = e.Offset
+		}
+		if offset > 0 {
+			return []error{&ConfigError{Filename: filename, Line: lineOf(data, int(offset)), Err: err}}, false
+		}
+		return []error{&ConfigError{Filename: filename, Err: err}}, false
+	}
+
+	w := &jsonWalker{filename: filename, data: data}
+	w.value(t, "")
+
+	return w.errs, true
+}
+
+func lineOf(data []byte, offset int) int {
+	if offset > len(data) {
+		offset = len(data)
+	}
+	return 1 + bytes.Count(data[:offset], []byte("\n"))
+}
+
+// jsonWalker walks the valid json data along a type, and reports the object
+// keys which match no struct field of the type.
+type jsonWalker struct {
+	filename string
+	data     []byte
+	pos      int
+	errs     []error
+}
+
+func (w *jsonWalker) skipSpace() {
+	for w.pos < len(w.data) && strings.IndexByte(" \t\r\n", w.data[w.pos]) >= 0 {
+		w.pos++
+	}
+}
+
+func (w *jsonWalker) value(t reflect.Type, path string) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	w.skipSpace()
+	if w.pos >= len(w.data) {
+		return
+	}
+
+	switch w.data[w.pos] {
+	case '{':
+		w.object(t, path)
+	case '[':
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		w.pos++
+		for i := 0; ; i++ {
+			w.skipSpace()
+			if w.pos >= len(w.data) || w.data[w.pos] == ']' {
+				w.pos++
+				return
+			}
+			w.value(elem, fmt.Sprintf("%s[%d]", path, i))
+			w.skipSpace()
+			if w.pos < len(w.data) && w.data[w.pos] == ',' {
+				w.pos++
+			}
+		}
+	case '"':
+		w.str()
+	default:
+		for w.pos < len(w.data) && strings.IndexByte(",]} \t\r\n", w.data[w.pos]) < 0 {
+			w.pos++
+		}
+	}
+}
+
+func (w *jsonWalker) object(t reflect.Type, path string) {
+	w.pos++
+	for {
+		w.skipSpace()
+		if w.pos >= len(w.data) || w.data[w.pos] == '}' {
+			w.pos++
+			return
+		}
+
+		start := w.pos
+		key := w.str()
+		w.skipSpace()
+		w.pos++ // ':'
+
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		var elem reflect.Type
+		if t != nil {
+			switch t.Kind() {
+			case reflect.Struct:
+				if f, ok := lookupField(t, key); ok {
+					elem = f.Type
+				} else {
+					err := fmt.Errorf("unknown key %#v", keyPath)
+					if name := suggestField(t, key); name != "" {
+						err = fmt.Errorf("unknown key %#v, did you mean %#v?", keyPath, name)
+					}
+					w.errs = append(w.errs, &ConfigError{Filename: w.filename, Line: lineOf(w.data, start), Err: err})
+				}
+			case reflect.Map:
+				elem = t.Elem()
+			}
+		}
+
+		w.value(elem, keyPath)
+
+		w.skipSpace()
+		if w.pos < len(w.data) && w.data[w.pos] == ',' {
+			w.pos++
+		}
+	}
+}
+
+func (w *jsonWalker) str() string {
+	start := w.pos
+	for w.pos++; w.pos < len(w.data) && w.data[w.pos] != '"'; w.pos++ {
+		if w.data[w.pos] == '\\' {
+			w.pos++
+		}
+	}
+	w.pos++
+
+	var s string
+	if w.pos <= len(w.data) {
+		json.Unmarshal(w.data[start:w.pos], &s)
+	}
+	return s
+}
+
+// fields returns the json decodable fields of the struct t, including the
+// ones of its embedded structs.
+func fields(t reflect.Type) []reflect.StructField {
+	var fs []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && f.Tag.Get("json") == "" {
+				fs = append(fs, fields(ft)...)
+				continue
+			}
+		}
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		if name := strings.Split(f.Tag.Get("json"), ",")[0]; name != "" {
+			f.Name = name
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+// lookupField finds the field of key, case-insensitively like encoding/json.
+func lookupField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for _, f := range fields(t) {
+		if strings.EqualFold(f.Name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// suggestField returns the field name closest to a misspelled key.
+func suggestField(t reflect.Type, key string) string {
+	var name string
+	best := 3
+	for _, f := range fields(t) {
+		if d := editDistance(strings.ToLower(f.Name), strings.ToLower(key)); d < best {
+			name, best = f.Name, d
+		}
+	}
+	return name
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
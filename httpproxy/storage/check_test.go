@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckJson(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	type profile struct {
+		Enabled bool
+		Address string
+		TLS     struct {
+			Enabled bool
+		}
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "test.json"), []byte(`{
+	"Default": {
+		// comments and trailing commas are fine
+		"Enabled": true,
+		"Address": "127.0.0.1:8087",
+	},
+}
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "test.user.json"), []byte(`{
+	"Default": {
+		"Adress": "127.0.0.1:8088",
+		"TLS": {
+			"Enabled": "yes",
+		},
+	},
+}
+`), 0644)
+
+	store := &FileStore{Dirname: dir}
+
+	config := make(map[string]profile)
+	errs, ok := CheckJson(store, "test.json", &config)
+	if ok || len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), filepath.Join(dir, "test.user.json")+":5: ") {
+		t.Fatalf("CheckJson should report the type error at line 5, got ok=%v %v", ok, errs)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "test.user.json"), []byte(`{
+	"Default": {
+		"Adress": "127.0.0.1:8088",
+		"TLS": {
+			"Enabled": true,
+		},
+	},
+}
+`), 0644)
+
+	errs, ok = CheckJson(store, "test.json", &config)
+	want := filepath.Join(dir, "test.user.json") + `:3: unknown key "Default.Adress", did you mean "Address"?`
+	if !ok || len(errs) != 1 || errs[0].Error() != want {
+		t.Fatalf("CheckJson should report %#v, got ok=%v %v", want, ok, errs)
+	}
+
+	if c := config["Default"]; !c.Enabled || c.Address != "127.0.0.1:8087" || !c.TLS.Enabled {
+		t.Errorf("CheckJson should decode the .user override into config, got %#v", c)
+	}
+
+	if _, ok = CheckJson(store, "missing.json", &config); ok {
+		t.Errorf("CheckJson should fail on a missing file")
+	}
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultSource is the source of the values which no file sets.
+	DefaultSource string = "(default)"
+	// Redacted replaces the secrets in a Dump.
+	Redacted string = "REDACTED"
+)
+
+// A Dump is an effective config with its secrets redacted, and the file
+// which each of its values comes from, keyed by dotted paths like
+// "Transport.Proxy.URL". Arrays are replaced as a whole by the later
+// files, so their elements share the source of the array.
+type Dump struct {
+	Config  map[string]interface{}
+	Sources map[string]string
+}
+
+// MergeJson decodes filenames and their .user overrides in store into config,
+// layered in order like UnmarshallJson does one by one, and returns the file
+// which each of the values in them comes from.
+func MergeJson(store Store, config interface{}, filenames ...string) (map[string]string, error) {
+	cm := make(map[string]interface{})
+	sources := make(map[string]string)
+
+	for _, filename := range filenames {
+		fileext := path.Ext(filename)
+		filename1 := strings.TrimSuffix(filename, fileext) + ".user" + fileext
+
+		for i, name := range []string{filename, filename1} {
+			resp, err := store.Get(name)
+			if err != nil {
+				if i == 0 {
+					return nil, err
+				}
+				continue
+			}
+			if resp.Body == nil {
+				continue
+			}
+
+			data, err := readJson(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+			cm1 := make(map[string]interface{})
+
+			d := json.NewDecoder(bytes.NewReader(data))
+			d.UseNumber()
+
+			if err = d.Decode(&cm1); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+
+			if err = mergeMap(cm, cm1); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+
+			walkLeaves(cm1, "", func(p string, v interface{}) {
+				sources[strings.ToLower(p)] = Path(store, name)
+			})
+		}
+	}
+
+	data, err := json.Marshal(cm)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	if err = d.Decode(config); err != nil {
+		return nil, err
+	}
+
+	return sources, nil
+}
+
+// NewDump encodes config, and looks up the sources returned by MergeJson for
+// its values. An option which the config merges from others when the filter
+// is built is looked up as the options in aliases, in order of precedence.
+func NewDump(config interface{}, sources map[string]string, aliases map[string][]string) (*Dump, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	dump := &Dump{
+		Config:  make(map[string]interface{}),
+		Sources: make(map[string]string),
+	}
+
+	if err = d.Decode(&dump.Config); err != nil {
+		return nil, err
+	}
+
+	walkLeaves(dump.Config, "", func(p string, v interface{}) {
+		dump.Sources[p] = lookupSource(sources, aliases, p)
+	})
+
+	redact(dump.Config)
+
+	return dump, nil
+}
+
+// WriteJsonc writes the config of d as JSONC, with a comment line of the
+// source before the values whose source differs from the values above.
+// prefix is the indentation of the line which the config starts on, and the
+// closing brace is not followed by a newline.
+func (d *Dump) WriteJsonc(w io.Writer, prefix string) error {
+	var b bytes.Buffer
+	var last string
+	d.writeJsonc(&b, d.Config, "", prefix, &last)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func (d *Dump) writeJsonc(b *bytes.Buffer, m map[string]interface{}, p, indent string, last *string) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b.WriteString("{\n")
+	for i, key := range keys {
+		p1 := joinPath(p, key)
+		v := m[key]
+
+		if m1, ok := v.(map[string]interface{}); ok && len(m1) > 0 {
+			fmt.Fprintf(b, "%s\t%q: ", indent, key)
+			d.writeJsonc(b, m1, p1, indent+"\t", last)
+		} else {
+			if source := d.Sources[p1]; source != *last {
+				fmt.Fprintf(b, "%s\t// %s\n", indent, source)
+				*last = source
+			}
+			data, _ := json.MarshalIndent(v, indent+"\t", "\t")
+			fmt.Fprintf(b, "%s\t%q: %s", indent, key, data)
+		}
+
+		if i < len(keys)-1 {
+			b.WriteByte(',')
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteString(indent + "}")
+}
+
+// walkLeaves calls fn with the values of m which are not non-empty objects.
+func walkLeaves(m map[string]interface{}, p string, fn func(p string, v interface{})) {
+	for key, v := range m {
+		p1 := joinPath(p, key)
+		if m1, ok := v.(map[string]interface{}); ok && len(m1) > 0 {
+			walkLeaves(m1, p1, fn)
+		} else {
+			fn(p1, v)
+		}
+	}
+}
+
+func joinPath(p, key string) string {
+	if p == "" {
+		return key
+	}
+	return p + "." + key
+}
+
+// lookupSource returns the source of path p, or of the nearest value above
+// it which a file sets as a whole. The keys are matched case-insensitively
+// like encoding/json does.
+func lookupSource(sources map[string]string, aliases map[string][]string, p string) string {
+	candidates := []string{p}
+
+	key, rest := p, ""
+	if i := strings.Index(p, "."); i >= 0 {
+		key, rest = p[:i], p[i:]
+	}
+	if names, ok := aliases[key]; ok {
+		candidates = candidates[:0]
+		for _, name := range names {
+			candidates = append(candidates, name+rest)
+		}
+	}
+
+	for _, p1 := range candidates {
+		p1 = strings.ToLower(p1)
+		for {
+			if source, ok := sources[p1]; ok {
+				return source
+			}
+			i := strings.LastIndex(p1, ".")
+			if i < 0 {
+				break
+			}
+			p1 = p1[:i]
+		}
+	}
+
+	return DefaultSource
+}
+
+// redact replaces the values of the password, secret and token options, and
+// the passwords in URLs.
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, v1 := range v {
+			if s, ok := v1.(string); ok && s != "" && isSecret(key) {
+				v[key] = Redacted
+			} else {
+				v[key] = redact(v1)
+			}
+		}
+	case []interface{}:
+		for i, v1 := range v {
+			v[i] = redact(v1)
+		}
+	case string:
+		if strings.Contains(v, "://") && strings.Contains(v, "@") {
+			if u, err := url.Parse(v); err == nil && u.User != nil {
+				if _, ok := u.User.Password(); ok {
+					u.User = url.UserPassword(u.User.Username(), Redacted)
+					return u.String()
+				}
+			}
+		}
+	}
+	return v
+}
+
+func isSecret(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"password", "secret", "token"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	httpStoreMetaSuffix string        = ".meta"
+	httpStoreListName   string        = ".list"
+	httpStoreTimeout    time.Duration = 30 * time.Second
+	httpStoreRetryDelay time.Duration = 1 * time.Minute
+)
+
+// HTTPStore reads the objects under URL over HTTP, like a directory served by
+// a web server. The objects are cached in CacheDir with their ETag and
+// Last-Modified, which make the later reads conditional, and the cache is
+// served when the server cannot be reached, so that it still starts offline.
+// Once a request fails to reach the server, the requests in the next minute
+// are served from the cache without trying. Head of a cached object is served
+// from the cache, the Get which follows revalidates it.
+// Put, Copy and Delete are sent as PUT and DELETE requests if EnablePut is
+// set, or return ErrNotImplemented.
+//
+// List requests the name with a trailing slash, and expects a JSON array of
+// the names in it.
+type HTTPStore struct {
+	URL       string
+	CacheDir  string
+	EnablePut bool
+	Client    *http.Client
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+var _ Store = &HTTPStore{}
+
+// NewHTTPStore returns a HTTPStore of rawurl, which must be a http or https
+// URL.
+func NewHTTPStore(rawurl string, cacheDir string) (*HTTPStore, error) {
+	if !strings.HasPrefix(rawurl, "http://") && !strings.HasPrefix(rawurl, "https://") {
+		return nil, fmt.Errorf("storage: %#v is not a http or https URL", rawurl)
+	}
+
+	return &HTTPStore{
+		URL:      strings.TrimRight(rawurl, "/") + "/",
+		CacheDir: cacheDir,
+		Client:   &http.Client{Timeout: httpStoreTimeout},
+	}, nil
+}
+
+func (s *HTTPStore) url(name string) string {
+	return s.URL + strings.TrimLeft(name, "/")
+}
+
+func (s *HTTPStore) notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: s.url(name), Err: os.ErrNotExist}
+}
+
+func (s *HTTPStore) cache() *FileStore {
+	if s.CacheDir == "" {
+		return nil
+	}
+	return &FileStore{s.CacheDir}
+}
+
+// cachedHeader returns the ETag and Last-Modified of the cached name, or nil
+// if name is not cached.
+func (s *HTTPStore) cachedHeader(name string) http.Header {
+	cache := s.cache()
+	if cache == nil {
+		return nil
+	}
+
+	if _, err := cache.Head(name); err != nil {
+		return nil
+	}
+
+	header := http.Header{}
+
+	resp, err := cache.Get(name + httpStoreMetaSuffix)
+	if err != nil {
+		return header
+	}
+	defer resp.Body.Close()
+
+	json.NewDecoder(resp.Body).Decode(&header)
+
+	return header
+}
+
+func (s *HTTPStore) putCache(name string, header http.Header, data []byte) {
+	cache := s.cache()
+	if cache == nil {
+		return
+	}
+
+	meta := http.Header{}
+	for _, key := range []string{"ETag", "Last-Modified", "Content-Type"} {
+		if v := header.Get(key); v != "" {
+			meta.Set(key, v)
+		}
+	}
+
+	b, _ := json.Marshal(meta)
+
+	if _, err := cache.Put(name, nil, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		glog.Warningf("HTTPStore: cache %#v error: %+v", name, err)
+		return
+	}
+	if _, err := cache.Put(name+httpStoreMetaSuffix, nil, ioutil.NopCloser(bytes.NewReader(b))); err != nil {
+		glog.Warningf("HTTPStore: cache %#v error: %+v", name, err)
+	}
+}
+
+func (s *HTTPStore) deleteCache(name string) {
+	if cache := s.cache(); cache != nil {
+		cache.Delete(name)
+		cache.Delete(name + httpStoreMetaSuffix)
+	}
+}
+
+// getCache serves name from the cache, in place of a failed request.
+func (s *HTTPStore) getCache(method, name string, header http.Header, err error) (*http.Response, error) {
+	cache := s.cache()
+	if cache == nil || header == nil {
+		if err == nil {
+			return nil, s.notExist(method, name)
+		}
+		return nil, err
+	}
+
+	var resp *http.Response
+	var err1 error
+	if method == http.MethodHead {
+		resp, err1 = cache.Head(name)
+	} else {
+		resp, err1 = cache.Get(name)
+	}
+	if err1 != nil {
+		return nil, err1
+	}
+
+	for key := range header {
+		resp.Header.Set(key, header.Get(key))
+	}
+
+	return resp, nil
+}
+
+// down reports whether the server was unreachable lately.
+func (s *HTTPStore) down() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.downUntil)
+}
+
+func (s *HTTPStore) setDown() {
+	s.mu.Lock()
+	s.downUntil = time.Now().Add(httpStoreRetryDelay)
+	s.mu.Unlock()
+}
+
+// do sends a GET or HEAD request of name, and caches the response as key.
+func (s *HTTPStore) do(method, name, key string) (*http.Response, error) {
+	header := s.cachedHeader(key)
+
+	if method == http.MethodHead && header != nil {
+		return s.getCache(method, key, header, nil)
+	}
+
+	if s.down() {
+		return s.getCache(method, key, header, nil)
+	}
+
+	req, err := http.NewRequest(method, s.url(name), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if method == http.MethodGet && header != nil {
+		if v := header.Get("ETag"); v != "" {
+			req.Header.Set("If-None-Match", v)
+		}
+		if v := header.Get("Last-Modified"); v != "" {
+			req.Header.Set("If-Modified-Since", v)
+		}
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		s.setDown()
+	} else if resp.StatusCode >= http.StatusInternalServerError {
+		resp.Body.Close()
+		err = fmt.Errorf("HTTPStore: %s %s: %s", method, req.URL.String(), resp.Status)
+	}
+	if err != nil {
+		if header == nil {
+			// the server is unreachable, and name is unknown
+			glog.Warningf("HTTPStore: %s %s error: %+v", method, req.URL.String(), err)
+			return nil, s.notExist(method, name)
+		}
+		glog.Warningf("HTTPStore: %s %s error: %+v, serve the cache instead", method, req.URL.String(), err)
+		return s.getCache(method, key, header, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if method == http.MethodHead {
+			return resp, nil
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return s.getCache(method, key, header, err)
+		}
+
+		s.putCache(key, resp.Header, data)
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		resp.ContentLength = int64(len(data))
+
+		return resp, nil
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return s.getCache(method, key, header, nil)
+	case http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		s.deleteCache(key)
+		return nil, s.notExist(method, name)
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTPStore: %s %s: %s", method, req.URL.String(), resp.Status)
+	}
+}
+
+func (s *HTTPStore) Get(name string) (*http.Response, error) {
+	return s.do(http.MethodGet, name, name)
+}
+
+func (s *HTTPStore) Head(name string) (*http.Response, error) {
+	return s.do(http.MethodHead, name, name)
+}
+
+func (s *HTTPStore) List(name string) ([]string, error) {
+	name = strings.TrimRight(name, "/") + "/"
+
+	resp, err := s.do(http.MethodGet, name, path.Join(name, httpStoreListName))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var names []string
+	if err = json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, fmt.Errorf("HTTPStore: List(%#v) error: %+v", name, err)
+	}
+
+	for i, name1 := range names {
+		names[i] = path.Join(name, name1)
+	}
+
+	return names, nil
+}
+
+func (s *HTTPStore) send(method, name string, header http.Header, body io.Reader) (*http.Response, error) {
+	if !s.EnablePut {
+		return nil, ErrNotImplemented
+	}
+
+	req, err := http.NewRequest(method, s.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return resp, s.notExist(method, name)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return resp, fmt.Errorf("HTTPStore: %s %s: %s", method, req.URL.String(), resp.Status)
+	}
+
+	s.deleteCache(name)
+
+	return resp, nil
+}
+
+func (s *HTTPStore) Put(name string, header http.Header, data io.ReadCloser) (*http.Response, error) {
+	defer data.Close()
+	return s.send(http.MethodPut, name, header, data)
+}
+
+func (s *HTTPStore) Copy(dest string, src string) (*http.Response, error) {
+	if !s.EnablePut {
+		return nil, ErrNotImplemented
+	}
+
+	resp, err := s.Get(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Put(dest, http.Header{}, resp.Body)
+}
+
+func (s *HTTPStore) Delete(name string) (*http.Response, error) {
+	return s.send(http.MethodDelete, name, nil, nil)
+}
+
+func (s *HTTPStore) UnmarshallJson(name string, config interface{}) error {
+	return readJsonConfig(s, name, config)
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHTTPStore(t *testing.T) {
+	files := map[string]string{
+		"/gae.user.json":     `{"AppIDs": ["a"]}`,
+		"/rules/gfwlist.txt": "||example.com",
+	}
+
+	var notModified int32
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/rules/" {
+			json.NewEncoder(rw).Encode([]string{"gfwlist.txt"})
+			return
+		}
+		data, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		etag := `"` + req.URL.Path + `"`
+		if req.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", etag)
+		rw.Write([]byte(data))
+	}))
+	defer ts.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	store, err := NewHTTPStore(ts.URL, dir)
+	if err != nil {
+		t.Fatalf("NewHTTPStore(%#v) error: %+v", ts.URL, err)
+	}
+
+	var requests int32
+	store.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return http.DefaultTransport.RoundTrip(req)
+	})
+
+	for i := 0; i < 2; i++ {
+		if s := getString(store, "gae.user.json"); s != files["/gae.user.json"] {
+			t.Errorf("store.Get(%#v) should return the file, got %#v", "gae.user.json", s)
+		}
+	}
+	if atomic.LoadInt32(&notModified) != 1 {
+		t.Errorf("the second store.Get should be served from the cache by 304 Not Modified")
+	}
+
+	var config struct{ AppIDs []string }
+	if err := store.UnmarshallJson("gae.user.json", &config); err != nil || !reflect.DeepEqual(config.AppIDs, []string{"a"}) {
+		t.Errorf("store.UnmarshallJson should decode the file, got %#v, %+v", config, err)
+	}
+
+	if names, err := store.List("rules"); err != nil || !reflect.DeepEqual(names, []string{"rules/gfwlist.txt"}) {
+		t.Errorf("store.List should return the JSON listing, got %#v, %+v", names, err)
+	}
+
+	if !IsNotExist(store.Get("gae.json")) {
+		t.Errorf("store.Get of a missing file should be not exist")
+	}
+
+	if _, err := store.Put("gae.json", http.Header{}, ioutil.NopCloser(strings.NewReader("{}"))); err != ErrNotImplemented {
+		t.Errorf("store.Put should not be implemented unless EnablePut, got %+v", err)
+	}
+
+	n := atomic.LoadInt32(&requests)
+	if _, err := store.Head("gae.user.json"); err != nil || atomic.LoadInt32(&requests) != n {
+		t.Errorf("store.Head of a cached file should be served from the cache, got %+v", err)
+	}
+
+	ts.Close()
+
+	if s := getString(store, "gae.user.json"); s != files["/gae.user.json"] {
+		t.Errorf("store.Get should serve the cache when the server is down, got %#v", s)
+	}
+	if names, err := store.List("rules"); err != nil || len(names) != 1 {
+		t.Errorf("store.List should serve the cache when the server is down, got %#v, %+v", names, err)
+	}
+	if !IsNotExist(store.Get("autoproxy.json")) {
+		t.Errorf("store.Get of an uncached file should be not exist when the server is down")
+	}
+	if n := atomic.LoadInt32(&requests); n != 7 {
+		t.Errorf("only the first request should try the server once it is down, got %d requests", n)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
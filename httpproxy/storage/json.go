@@ -61,6 +61,8 @@ func readJsonConfig(store Store, filename string, config interface{}) error {
 	return d.Decode(config)
 }
 
+// readJson strips the comment lines and the trailing commas of r, the lines
+// are kept so that the offsets of json errors still point to them.
 func readJson(r io.Reader) ([]byte, error) {
 
 	s, err := ioutil.ReadAll(r)
@@ -68,29 +70,35 @@ func readJson(r io.Reader) ([]byte, error) {
 		return s, err
 	}
 
-	lines := make([]string, 0)
-	for _, line := range strings.Split(strings.Replace(string(s), "\r\n", "\n", -1), "\n") {
+	lines := strings.Split(strings.Replace(string(s), "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
 		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "//") {
-			continue
+		if strings.HasPrefix(line, "//") {
+			line = ""
 		}
-		lines = append(lines, line)
+		lines[i] = line
 	}
 
 	var b bytes.Buffer
 	for i, line := range lines {
-		if i < len(lines)-1 {
-			nextLine := strings.TrimSpace(lines[i+1])
+		if strings.HasSuffix(line, ",") {
+			var nextLine string
+			for _, nextLine = range lines[i+1:] {
+				if nextLine != "" {
+					break
+				}
+			}
 			if nextLine == "]" ||
 				nextLine == "]," ||
 				nextLine == "}" ||
 				nextLine == "}," {
-				if strings.HasSuffix(line, ",") {
-					line = strings.TrimSuffix(line, ",")
-				}
+				line = strings.TrimSuffix(line, ",")
 			}
 		}
 		b.WriteString(line)
+		if i < len(lines)-1 {
+			b.WriteByte('\n')
+		}
 	}
 
 	return b.Bytes(), nil
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	whiteoutPrefix string = ".wh."
+)
+
+// OverlayStore reads through Stores from the top down, and writes to the top
+// one, so that the lower ones may be read-only defaults like a ZipStore. A
+// name which is deleted while a lower store still has it is hidden by an
+// empty whiteout ".wh.<name>" in the top store, until it is put again.
+type OverlayStore struct {
+	Stores []Store
+}
+
+var _ Store = &OverlayStore{}
+
+func whiteout(name string) string {
+	return path.Join(path.Dir(name), whiteoutPrefix+path.Base(name))
+}
+
+// lookup returns the top store which has name, or nil if none has or a
+// whiteout hides it.
+func (s *OverlayStore) lookup(name string) (Store, error) {
+	for _, store := range s.Stores {
+		if _, err := store.Head(name); err == nil {
+			return store, nil
+		} else if !IsNotExist(nil, err) {
+			return nil, err
+		}
+		if _, err := store.Head(whiteout(name)); err == nil {
+			break
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+func (s *OverlayStore) Get(name string) (*http.Response, error) {
+	store, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(name)
+}
+
+func (s *OverlayStore) Head(name string) (*http.Response, error) {
+	store, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return store.Head(name)
+}
+
+// List merges the names under name of all stores, without the hidden ones.
+func (s *OverlayStore) List(name string) ([]string, error) {
+	seen := make(map[string]struct{})
+	hidden := make(map[string]struct{})
+	names := make([]string, 0)
+
+	var found bool
+	for _, store := range s.Stores {
+		names1, err := store.List(name)
+		if err != nil {
+			if IsNotExist(nil, err) {
+				continue
+			}
+			return nil, err
+		}
+		found = true
+
+		var whiteouts []string
+		for _, name1 := range names1 {
+			if base := path.Base(name1); strings.HasPrefix(base, whiteoutPrefix) {
+				whiteouts = append(whiteouts, path.Join(path.Dir(name1), strings.TrimPrefix(base, whiteoutPrefix)))
+				continue
+			}
+			if _, ok := seen[name1]; ok {
+				continue
+			}
+			if _, ok := hidden[name1]; ok {
+				continue
+			}
+			seen[name1] = struct{}{}
+			names = append(names, name1)
+		}
+
+		for _, name1 := range whiteouts {
+			hidden[name1] = struct{}{}
+		}
+	}
+
+	if !found {
+		return nil, os.ErrNotExist
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (s *OverlayStore) Put(name string, header http.Header, data io.ReadCloser) (*http.Response, error) {
+	top := s.Stores[0]
+
+	resp, err := top.Put(name, header, data)
+	if err != nil {
+		return resp, err
+	}
+
+	if _, err := top.Head(whiteout(name)); err == nil {
+		if _, err := top.Delete(whiteout(name)); err != nil {
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+func (s *OverlayStore) Copy(dest string, src string) (*http.Response, error) {
+	resp, err := s.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	return s.Put(dest, resp.Header, resp.Body)
+}
+
+// Delete deletes name from the top store, and leaves a whiteout there if a
+// lower store still has it.
+func (s *OverlayStore) Delete(name string) (*http.Response, error) {
+	top := s.Stores[0]
+
+	resp, err := top.Delete(name)
+	if err != nil && !IsNotExist(resp, err) {
+		return resp, err
+	}
+
+	if _, err1 := s.lookup(name); err1 != nil {
+		return resp, err
+	}
+
+	return top.Put(whiteout(name), http.Header{}, ioutil.NopCloser(bytes.NewReader(nil)))
+}
+
+func (s *OverlayStore) UnmarshallJson(name string, config interface{}) error {
+	return readJsonConfig(s, name, config)
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOverlayStore(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for name, data := range map[string]string{"a.json": "zip a", "b.json": "zip b", "c.json": "zip c"} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(data))
+	}
+	zw.Close()
+	ioutil.WriteFile(filepath.Join(dir, "defaults.zip"), b.Bytes(), 0644)
+
+	os.MkdirAll(filepath.Join(dir, "user"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "user", "a.json"), []byte("user a"), 0644)
+
+	store := NewOverlayStore([]string{filepath.Join(dir, "user"), filepath.Join(dir, "defaults.zip")}, "test")
+
+	if s := getString(store, "a.json"); s != "user a" {
+		t.Errorf("a.json should be read from the top store, got %#v", s)
+	}
+	if s := getString(store, "b.json"); s != "zip b" {
+		t.Errorf("b.json should be read through to the zip store, got %#v", s)
+	}
+
+	if _, err := store.Put("b.json", http.Header{}, ioutil.NopCloser(bytes.NewBufferString("user b"))); err != nil {
+		t.Fatalf("store.Put error: %+v", err)
+	}
+	if s := getString(store, "b.json"); s != "user b" {
+		t.Errorf("b.json should be written to the top store, got %#v", s)
+	}
+
+	if _, err := store.Delete("c.json"); err != nil {
+		t.Fatalf("store.Delete error: %+v", err)
+	}
+	if !IsNotExist(store.Get("c.json")) {
+		t.Errorf("c.json should be hidden by a whiteout")
+	}
+
+	if names, err := store.List(""); err != nil || !reflect.DeepEqual(names, []string{"a.json", "b.json"}) {
+		t.Errorf("store.List should merge the layers without c.json, got %#v, %+v", names, err)
+	}
+
+	if _, err := store.Put("c.json", http.Header{}, ioutil.NopCloser(bytes.NewBufferString("user c"))); err != nil {
+		t.Fatalf("store.Put error: %+v", err)
+	}
+	if s := getString(store, "c.json"); s != "user c" {
+		t.Errorf("c.json should be put back over the whiteout, got %#v", s)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "user", ".wh.c.json")); !os.IsNotExist(err) {
+		t.Errorf("the whiteout of c.json should be removed, got %+v", err)
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/phuslu/glog"
 )
 
 const (
@@ -26,8 +30,81 @@ type Store interface {
 	UnmarshallJson(name string, config interface{}) error
 }
 
+const (
+	// StoreEnv lists the layers of the stores returned by
+	// LookupStoreByFilterName from the top down, separated like PATH. A layer
+	// is a directory, or a ".zip" file of read-only defaults. In a layer,
+	// "{exe}" is replaced with the directory of the executable and "{name}"
+	// with the filter name, and the environment variables are expanded.
+	StoreEnv string = "GOPROXY_STORE"
+	// RemoteStoreEnvPrefix followed by an upper case filter name, like
+	// GOPROXY_STORE_URL_GAE, is the URL of the remote store of the filter,
+	// which overrides the one set by SetRemoteStore.
+	RemoteStoreEnvPrefix string = "GOPROXY_STORE_URL_"
+	// RemoteStoreCacheDir is where the remote stores cache their objects,
+	// in a directory of each filter.
+	RemoteStoreCacheDir string = "cache/store"
+)
+
+var (
+	zipStores      = make(map[string]*ZipStore)
+	zipStoresMu    sync.Mutex
+	remoteStores   = make(map[string]Store)
+	remoteStoresMu sync.Mutex
+)
+
+// SetRemoteStore makes LookupStoreByFilterName layer the local store of filter
+// name over store, so that the files missing locally are read from store, or
+// stops doing so if store is nil. The writes still go to the local store,
+// which keeps the state of the filter off the usually read-only HTTPStore.
+func SetRemoteStore(name string, store Store) {
+	remoteStoresMu.Lock()
+	defer remoteStoresMu.Unlock()
+
+	if store == nil {
+		delete(remoteStores, name)
+	} else {
+		remoteStores[name] = store
+	}
+}
+
+func lookupRemoteStore(name string) Store {
+	remoteStoresMu.Lock()
+	defer remoteStoresMu.Unlock()
+
+	if rawurl := os.Getenv(RemoteStoreEnvPrefix + strings.ToUpper(name)); rawurl != "" {
+		key := RemoteStoreEnvPrefix + name
+		if s, ok := remoteStores[key]; ok && s.(*HTTPStore).URL == strings.TrimRight(rawurl, "/")+"/" {
+			return s
+		}
+		s, err := NewHTTPStore(rawurl, filepath.Join(RemoteStoreCacheDir, name))
+		if err != nil {
+			glog.Errorf("storage.NewHTTPStore(%#v) error: %+v", rawurl, err)
+			return nil
+		}
+		remoteStores[key] = s
+		return s
+	}
+
+	return remoteStores[name]
+}
+
 // Lookup config uri by filename
 func LookupStoreByFilterName(name string) Store {
+	store := lookupLocalStore(name)
+
+	if remote := lookupRemoteStore(name); remote != nil {
+		return &OverlayStore{Stores: []Store{store, remote}}
+	}
+
+	return store
+}
+
+func lookupLocalStore(name string) Store {
+	if layers := os.Getenv(StoreEnv); layers != "" {
+		return NewOverlayStore(filepath.SplitList(layers), name)
+	}
+
 	var store Store
 
 	exe, err := os.Executable()
@@ -48,6 +125,46 @@ func LookupStoreByFilterName(name string) Store {
 	return store
 }
 
+// NewOverlayStore returns the OverlayStore of layers for filter name, see
+// StoreEnv for the syntax of layers. The ZipStores are shared, so that each
+// zip file is read once.
+func NewOverlayStore(layers []string, name string) *OverlayStore {
+	exe, err := os.Executable()
+	if err != nil {
+		println("os.Executable() error: ", err)
+	}
+
+	s := &OverlayStore{}
+	for _, layer := range layers {
+		if layer == "" {
+			continue
+		}
+
+		layer = strings.Replace(layer, "{exe}", filepath.Dir(exe), -1)
+		layer = strings.Replace(layer, "{name}", name, -1)
+		layer = os.ExpandEnv(layer)
+
+		if strings.EqualFold(filepath.Ext(layer), ".zip") {
+			zipStoresMu.Lock()
+			zs, ok := zipStores[layer]
+			if !ok {
+				zs = &ZipStore{Filename: layer}
+				zipStores[layer] = zs
+			}
+			zipStoresMu.Unlock()
+			s.Stores = append(s.Stores, zs)
+		} else {
+			s.Stores = append(s.Stores, &FileStore{layer})
+		}
+	}
+
+	if len(s.Stores) == 0 {
+		s.Stores = append(s.Stores, &FileStore{"."})
+	}
+
+	return s
+}
+
 func IsNotExist(resp *http.Response, err error) bool {
 	return os.IsNotExist(err) || (resp != nil && resp.StatusCode == http.StatusNotFound)
 }
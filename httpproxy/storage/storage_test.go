@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempDir returns a new temporary directory, and the func to remove it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "storage-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir error: %+v", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// getString returns the content of name in store, or the error of reading it.
+func getString(store Store, name string) string {
+	resp, err := store.Get(name)
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func TestLookupStoreByFilterNameRemote(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/test.json", "/test.user.json":
+			rw.Write([]byte("remote " + req.URL.Path))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer ts.Close()
+
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	ioutil.WriteFile(filepath.Join(dir, "test.json"), []byte("local"), 0644)
+
+	os.Setenv(StoreEnv, dir)
+	defer os.Unsetenv(StoreEnv)
+
+	remote, _ := NewHTTPStore(ts.URL, filepath.Join(dir, "cache"))
+	SetRemoteStore("test", remote)
+	defer SetRemoteStore("test", nil)
+
+	store := LookupStoreByFilterName("test")
+
+	if s := getString(store, "test.json"); s != "local" {
+		t.Errorf("test.json should be read from the local store, got %#v", s)
+	}
+	if s := getString(store, "test.user.json"); s != "remote /test.user.json" {
+		t.Errorf("test.user.json should be read through to the remote store, got %#v", s)
+	}
+
+	if _, err := store.Put("ipstate.json", http.Header{}, ioutil.NopCloser(strings.NewReader("{}"))); err != nil {
+		t.Fatalf("store.Put should write to the local store, got %+v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ipstate.json")); err != nil {
+		t.Errorf("ipstate.json should be written to the local store, got %+v", err)
+	}
+}
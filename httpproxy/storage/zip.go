@@ -9,23 +9,28 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type ZipStore struct {
 	Filename string
 	zfs      map[string]*zip.File
+	mu       sync.Mutex
 }
 
 var _ Store = &ZipStore{}
 
 func (s *ZipStore) init() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.zfs != nil {
 		return nil
 	}
 
 	var err error
 
-	f, err := os.OpenFile(s.Filename, os.O_RDWR, 0644)
+	f, err := os.Open(s.Filename)
 	if err != nil {
 		return err
 	}
@@ -92,6 +97,9 @@ func (s *ZipStore) List(name string) ([]string, error) {
 	}
 
 	prefix := strings.TrimRight(name, "/") + "/"
+	if prefix == "/" {
+		prefix = ""
+	}
 	names := make([]string, 0)
 	for key := range s.zfs {
 		if strings.HasPrefix(key, prefix) {
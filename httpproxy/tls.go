@@ -0,0 +1,147 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"./filters"
+	"./filters/stripssl"
+	"./helpers"
+)
+
+const (
+	listenerCertCacheSize uint          = 256
+	listenerCertExpiry    time.Duration = 7 * 24 * time.Hour
+)
+
+// NewTLSConfig returns the tls.Config of a HTTPS proxy profile, or nil if
+// TLS is not enabled.
+func NewTLSConfig(config Config) (*tls.Config, error) {
+	c := config.TLS
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:               tls.VersionTLS10,
+		PreferServerCipherSuites: true,
+		NextProtos:               []string{"http/1.1"},
+	}
+
+	switch {
+	case c.CertFile != "" && c.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.LoadX509KeyPair(%#v, %#v) error: %+v", c.CertFile, c.KeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case c.IssueByRootCA:
+		getCertificate, err := newRootCAGetCertificate(config)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetCertificate = getCertificate
+	default:
+		return nil, fmt.Errorf("TLS needs CertFile and KeyFile, or IssueByRootCA")
+	}
+
+	if c.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in ClientCAFile %#v", c.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// newRootCAGetCertificate issues the listener certificates from the RootCA of
+// the stripssl filter, for TLS.ServerName or else the listen host, whatever the
+// SNI of clients is. Only a listener on all addresses without a ServerName
+// issues the certificates for the SNI, which are kept in a bounded cache.
+func newRootCAGetCertificate(config Config) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	f, err := filters.GetFilter("stripssl")
+	if err != nil {
+		return nil, fmt.Errorf("filters.GetFilter(\"stripssl\") error: %+v", err)
+	}
+
+	f1, ok := f.(*stripssl.Filter)
+	if !ok {
+		return nil, fmt.Errorf("%#v is not a stripssl filter", f)
+	}
+
+	serverName := config.TLS.ServerName
+	if serverName == "" {
+		if host, _, err := net.SplitHostPort(config.Address); err == nil {
+			serverName = host
+		}
+	}
+
+	type issueCall struct {
+		wg   sync.WaitGroup
+		cert *tls.Certificate
+		err  error
+	}
+
+	var mu sync.Mutex
+	certs := lrucache.NewLRUCache(listenerCertCacheSize)
+	calls := make(map[string]*issueCall)
+
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := serverName
+		if name == "" {
+			name = hello.ServerName
+		}
+
+		name = stripssl.GetCommonName(name)
+		ecc := helpers.HasECCCiphers(hello.CipherSuites)
+
+		key := name
+		if !ecc {
+			key += ",rsa"
+		}
+
+		mu.Lock()
+		if cert, ok := certs.Get(key); ok {
+			mu.Unlock()
+			return cert.(*tls.Certificate), nil
+		}
+		// issue a certificate once for the concurrent handshakes of key
+		if c, ok := calls[key]; ok {
+			mu.Unlock()
+			c.wg.Wait()
+			return c.cert, c.err
+		}
+		c := new(issueCall)
+		c.wg.Add(1)
+		calls[key] = c
+		mu.Unlock()
+
+		glog.V(2).Infof("httpproxy: issue listener certificate %#v from %s", name, f1.Config.RootCA.Name)
+		c.cert, c.err = f1.CA.Issue(name, f1.CAExpiry, ecc)
+
+		mu.Lock()
+		delete(calls, key)
+		if c.err == nil {
+			certs.Set(key, c.cert, time.Now().Add(listenerCertExpiry))
+		}
+		mu.Unlock()
+		c.wg.Done()
+
+		return c.cert, c.err
+	}, nil
+}
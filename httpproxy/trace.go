@@ -0,0 +1,93 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"./filters"
+)
+
+const (
+	TraceHeader string = "X-GoProxy-Trace"
+)
+
+// TracePolicy returns the filters.Tracef decisions of a request in the
+// X-GoProxy-Trace response header, if the client asks for it by Header from
+// one of AllowedIPs, and logs them at Verbosity.
+type TracePolicy struct {
+	Header     string
+	AllowedIPs []*net.IPNet
+	Verbosity  glog.Level
+}
+
+func NewTracePolicy(header string, allowedIPs []string, verbosity int) (*TracePolicy, error) {
+	p := &TracePolicy{
+		Header:    header,
+		Verbosity: glog.Level(verbosity),
+	}
+
+	if len(allowedIPs) == 0 {
+		allowedIPs = []string{"127.0.0.0/8", "::1"}
+	}
+
+	for _, s := range allowedIPs {
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("net.ParseCIDR(%#v) error: %+v", s, err)
+		}
+		p.AllowedIPs = append(p.AllowedIPs, ipnet)
+	}
+
+	return p, nil
+}
+
+// Requested removes the debug header from req, and reports whether it asked
+// for the trace from an allowed IP.
+func (p *TracePolicy) Requested(req *http.Request) bool {
+	if p.Header == "" || req.Header.Get(p.Header) == "" {
+		return false
+	}
+	req.Header.Del(p.Header)
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipnet := range p.AllowedIPs {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	glog.V(2).Infof("%s ask for %s, but not in AllowedIPs", req.RemoteAddr, TraceHeader)
+	return false
+}
+
+// Log logs the trace of req if Verbosity is enabled.
+func (p *TracePolicy) Log(ctx context.Context, req *http.Request) {
+	if p.Verbosity <= 0 || !glog.V(p.Verbosity) {
+		return
+	}
+
+	if trace := filters.FormatTrace(ctx); trace != "" {
+		glog.Infof("%s \"TRACE %s %s %s\" %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, trace)
+	}
+}
@@ -0,0 +1,108 @@
+package httpproxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"./helpers"
+)
+
+const (
+	TransparentRedirect string = "redirect"
+	TransparentTProxy   string = "tproxy"
+)
+
+// newTransparentListener returns a listener for connections diverted by an
+// iptables REDIRECT or TPROXY rule. TLS connections are turned into CONNECT
+// requests to their SNI, so that the RoundTripFilters may tunnel or strip
+// them, the others are returned from Accept with LocalAddr reporting the
+// original destination, which Handler uses for requests without a Host.
+func newTransparentListener(ln helpers.Listener, handler http.Handler, mode string, readTimeout time.Duration) net.Listener {
+	return newSniffListener(ln, func(l *sniffListener, conn net.Conn) {
+		dst, err := originalDst(conn, mode)
+		if err != nil {
+			glog.Warningf("%s transparent original destination error: %+v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+
+		if readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+
+		br := bufio.NewReaderSize(conn, 16384)
+		b, err := br.Peek(1)
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		if b[0] != 0x16 {
+			conn.SetReadDeadline(time.Time{})
+			l.Push(&transparentConn{bufferedConn{conn, br}, dst})
+			return
+		}
+
+		host := dst.IP.String()
+		if name, err := helpers.PeekServerName(br); err == nil && name != "" {
+			host = name
+		} else if err != helpers.ErrNoServerName {
+			glog.V(2).Infof("%s transparent peek TLS server_name error: %+v", conn.RemoteAddr(), err)
+		}
+
+		conn.SetReadDeadline(time.Time{})
+
+		addr := net.JoinHostPort(host, strconv.Itoa(dst.Port))
+		req := &http.Request{
+			Method:     http.MethodConnect,
+			URL:        &url.URL{Host: addr},
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Host:       addr,
+			RemoteAddr: conn.RemoteAddr().String(),
+			RequestURI: addr,
+		}
+
+		// the client believes it talks to addr directly, so there is no
+		// CONNECT response to send
+		serveConnect(conn, br, req, handler, func(code int) {
+			if code < 200 || code >= 300 {
+				glog.Warningf("%s transparent CONNECT %s failed with %d", conn.RemoteAddr(), addr, code)
+			}
+		})
+	})
+}
+
+// originalDst returns the destination the client dialed, for REDIRECT it is
+// recorded by conntrack, for TPROXY the socket keeps it as the local address.
+func originalDst(conn net.Conn, mode string) (*net.TCPAddr, error) {
+	if mode == TransparentRedirect {
+		return helpers.OriginalDst(conn)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	return addr, nil
+}
+
+// transparentConn reports the original destination as its LocalAddr, which
+// is passed to Handler as http.LocalAddrContextKey.
+type transparentConn struct {
+	bufferedConn
+	dst *net.TCPAddr
+}
+
+func (c *transparentConn) LocalAddr() net.Addr {
+	return c.dst
+}
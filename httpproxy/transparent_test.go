@@ -0,0 +1,36 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"./helpers"
+)
+
+func TestTransparentTLSConnect(t *testing.T) {
+	ln, err := helpers.ListenTCP("tcp", "127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("ListenTCP error: %+v", err)
+	}
+	defer ln.Close()
+
+	// without a TPROXY rule the original destination is the listener itself
+	h := echoConnectHandler{make(chan *http.Request, 1)}
+	go http.Serve(newTransparentListener(ln, h, TransparentTProxy, 0), h)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial(%#v) error: %+v", ln.Addr().String(), err)
+	}
+	defer conn.Close()
+
+	go tls.Client(conn, &tls.Config{ServerName: "example.org", InsecureSkipVerify: true}).Handshake()
+
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	if req := <-h.reqs; req.Method != http.MethodConnect || req.Host != "example.org:"+port {
+		t.Errorf("request should be CONNECT example.org:%s, got %s %s", port, req.Method, req.Host)
+	}
+}
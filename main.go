@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/phuslu/glog"
@@ -16,7 +19,6 @@ import (
 	"./httpproxy"
 	"./httpproxy/filters"
 	"./httpproxy/helpers"
-	"./httpproxy/storage"
 
 	"./httpproxy/filters/gae"
 	"./httpproxy/filters/php"
@@ -32,6 +34,37 @@ func init() {
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		errs := httpproxy.Check()
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		if len(errs) > 0 {
+			fmt.Fprintf(os.Stderr, "%d errors found\n", len(errs))
+			os.Exit(1)
+		}
+		fmt.Println("OK")
+		return
+	}
+
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "dump" {
+		format, name := "jsonc", ""
+		for _, arg := range os.Args[3:] {
+			if arg == "-json" {
+				format = "json"
+			} else {
+				name = arg
+			}
+		}
+		dumps, err := httpproxy.DumpConfig(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "httpproxy.DumpConfig(%#v) error: %+v\n", name, err)
+			os.Exit(1)
+		}
+		httpproxy.WriteConfigDump(os.Stdout, dumps, format)
+		return
+	}
+
 	if len(os.Args) > 1 {
 		var line string
 		switch os.Args[1] {
@@ -62,11 +95,9 @@ func main() {
 		helpers.SetConsoleTitle(fmt.Sprintf("GoProxy %s (go/%s)", version, gover))
 	}
 
-	config := make(map[string]httpproxy.Config)
-	filename := "httpproxy.json"
-	err := storage.LookupStoreByFilterName("httpproxy").UnmarshallJson(filename, &config)
+	config, err := httpproxy.ReadConfig()
 	if err != nil {
-		fmt.Printf("storage.LookupStoreByFilterName(%#v) failed: %s\n", filename, err)
+		fmt.Printf("httpproxy.ReadConfig(%#v) failed: %s\n", httpproxy.ConfigFilename, err)
 		return
 	}
 
@@ -77,6 +108,16 @@ GoProxy Version    : %s (go/%s %s/%s)`,
 		if !config.Enabled {
 			continue
 		}
+		if profile == httpproxy.AdminProfile {
+			fmt.Fprintf(os.Stderr, `
+Admin Address      : %s`, config.Address)
+			go func(config httpproxy.Config) {
+				if err := httpproxy.ServeAdmin(config); err != nil && err != http.ErrServerClosed {
+					glog.Errorf("httpproxy.ServeAdmin(%#v) error: %+v", config.Address, err)
+				}
+			}(config)
+			continue
+		}
 		addr := config.Address
 		if ip, port, err := net.SplitHostPort(addr); err == nil {
 			switch ip {
@@ -102,7 +143,7 @@ Enabled Filters    : %v`,
 				glog.Fatalf("filters.GetFilter(%#v) error: %+v", fn, err)
 			}
 
-			switch fn {
+			switch filterName, _ := filters.SplitName(fn); filterName {
 			case "autoproxy":
 				fmt.Fprintf(os.Stderr, `
 Pac Server         : http://%s/proxy.pac`, addr)
@@ -133,7 +174,7 @@ GAE Mode           : TLS`)
 PHP Servers         : %s`, strings.Join(urls, "|"))
 			}
 		}
-		go httpproxy.ServeProfile(config, "goproxy "+version)
+		go httpproxy.ServeProfile(profile, config, "goproxy "+version)
 	}
 	fmt.Fprintf(os.Stderr, "\n------------------------------------------------------\n")
 
@@ -144,5 +185,24 @@ PHP Servers         : %s`, strings.Join(urls, "|"))
 		}
 	}
 
-	select {}
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			glog.Infof("Received SIGHUP, reloading %#v and filter configs...", httpproxy.ConfigFilename)
+			if err := httpproxy.Reload(); err != nil {
+				glog.Errorf("httpproxy.Reload() error: %+v, keep running with old configs", err)
+				continue
+			}
+			glog.Infof("Reload %#v and filter configs OK", httpproxy.ConfigFilename)
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	sig := <-c
+
+	glog.Infof("Received %v, shutting down...", sig)
+	httpproxy.Shutdown()
+	glog.Flush()
 }
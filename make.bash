@@ -61,6 +61,7 @@ OBJECTS=${OBJECTDIR}/${GOPROXY_EXE}
 
 SOURCES="${REPO}/README.md \
         ${REPO}/assets/packaging/gae.user.json.example \
+        ${REPO}/httpproxy/filters/accesslog/accesslog.json \
         ${REPO}/httpproxy/filters/auth/auth.json \
         ${REPO}/httpproxy/filters/autoproxy/17monipdb.dat \
         ${REPO}/httpproxy/filters/autoproxy/autoproxy.json \
@@ -70,7 +71,9 @@ SOURCES="${REPO}/README.md \
         ${REPO}/httpproxy/filters/direct/direct.json \
         ${REPO}/httpproxy/filters/gae/gae.json \
         ${REPO}/httpproxy/filters/php/php.json \
+        ${REPO}/httpproxy/filters/ratelimit/ratelimit.json \
         ${REPO}/httpproxy/filters/rewrite/rewrite.json \
+        ${REPO}/httpproxy/filters/rules/rules.json \
         ${REPO}/httpproxy/filters/stripssl/stripssl.json \
 	${REPO}/httpproxy/httpproxy.json \
 	${REPO}/httpproxy/filters/gae/gscan.conf \